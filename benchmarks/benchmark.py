@@ -4,7 +4,7 @@ from pathlib import Path
 
 import httpx
 
-SERVER_CMD = ["go", "run", "benchmarks/server.go"]
+SERVER_CMD = ["go", "-C", "benchmarks", "run", "."]
 RUST_CLIENT_MANIFEST = Path("benchmarks/rust-client/Cargo.toml")
 RUST_BINARY = Path("benchmarks/rust-client/target/release/rust-client")
 URL = "http://localhost:8000/"
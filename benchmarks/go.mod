@@ -0,0 +1,9 @@
+module github.com/wolvever/httpx-transport-rs/benchmarks
+
+go 1.26.0
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.48.0
+)
@@ -0,0 +1,190 @@
+"""
+Concurrent load generator that drives the Rust transport against a target URL.
+
+Each worker thread owns an httpx client backed by ``rust_httpx.SyncTransport``
+and issues requests until its share of ``--requests`` is done or
+``--duration`` elapses. Throughput and latency percentiles are printed at the
+end. With ``--verify`` each body is checked against the server's
+``X-Body-Sha256`` header to catch corruption in the transport; the server
+only sends it as a header for bodies up to 1 MiB (larger ones get it as a
+trailer, which httpx does not expose), so keep verified targets below that.
+With ``--prime`` each worker first calls the server's ``/prime`` route
+outside the timed phase, so connection and TLS setup are not counted in the
+results.
+
+Example:
+    go -C benchmarks run . &
+    python benchmarks/load.py --concurrency 16 --requests 20000
+"""
+
+import argparse
+import hashlib
+import threading
+import time
+from typing import List, Optional
+from urllib.parse import urljoin
+
+import httpx
+
+import rust_httpx
+
+
+def make_client(transport: str) -> httpx.Client:
+    if transport == "rust":
+        return httpx.Client(transport=rust_httpx.SyncTransport())
+    return httpx.Client()
+
+
+class Worker(threading.Thread):
+    def __init__(
+        self,
+        url: str,
+        transport: str,
+        keepalive: bool,
+        verify: bool,
+        prime: bool,
+        quota: Optional[int],
+        duration: Optional[float],
+        start_barrier: threading.Barrier,
+    ) -> None:
+        super().__init__(daemon=True)
+        self.url = url
+        self.transport = transport
+        self.keepalive = keepalive
+        self.verify = verify
+        self.prime = prime
+        self.quota = quota
+        self.duration = duration
+        self.deadline: Optional[float] = None
+        self.start_barrier = start_barrier
+        self.latencies: List[float] = []
+        self.errors = 0
+        self.corrupt = 0
+
+    def _done(self, issued: int) -> bool:
+        if self.quota is not None and issued >= self.quota:
+            return True
+        return self.deadline is not None and time.perf_counter() >= self.deadline
+
+    def _request(self, client: httpx.Client) -> None:
+        start = time.perf_counter()
+        try:
+            response = client.get(self.url)
+            body = response.read()
+            response.raise_for_status()
+        except httpx.HTTPError:
+            self.errors += 1
+            return
+        self.latencies.append(time.perf_counter() - start)
+        if self.verify:
+            expected = response.headers.get("X-Body-Sha256")
+            if expected is None or hashlib.sha256(body).hexdigest() != expected:
+                self.corrupt += 1
+
+    def run(self) -> None:
+        client = make_client(self.transport) if self.keepalive else None
+        if client is not None and self.prime:
+            try:
+                client.get(urljoin(self.url, "/prime"))
+            except httpx.HTTPError:
+                pass
+        self.start_barrier.wait()
+        # The clock starts once every worker is primed, not when it started.
+        if self.duration is not None:
+            self.deadline = time.perf_counter() + self.duration
+        issued = 0
+        try:
+            while not self._done(issued):
+                if client is None:
+                    # A fresh client per request forces a new connection each time.
+                    with make_client(self.transport) as one_shot:
+                        self._request(one_shot)
+                else:
+                    self._request(client)
+                issued += 1
+        finally:
+            if client is not None:
+                client.close()
+
+
+def percentile(sorted_values: List[float], q: float) -> float:
+    if not sorted_values:
+        return 0.0
+    rank = min(int(q * len(sorted_values)), len(sorted_values) - 1)
+    return sorted_values[rank]
+
+
+def run_load(
+    url: str,
+    concurrency: int,
+    requests: Optional[int],
+    duration: Optional[float],
+    transport: str,
+    keepalive: bool,
+    verify: bool = False,
+    prime: bool = False,
+) -> None:
+    barrier = threading.Barrier(concurrency + 1)
+    workers = []
+    for i in range(concurrency):
+        quota = None
+        if requests is not None:
+            quota = requests // concurrency + (1 if i < requests % concurrency else 0)
+        workers.append(Worker(url, transport, keepalive, verify, prime, quota, duration, barrier))
+    for w in workers:
+        w.start()
+
+    barrier.wait()
+    start = time.perf_counter()
+    for w in workers:
+        w.join()
+    elapsed = time.perf_counter() - start
+
+    latencies = sorted(lat for w in workers for lat in w.latencies)
+    errors = sum(w.errors for w in workers)
+    completed = len(latencies)
+    print(f"Target: {url} ({transport} transport, keep-alive {'on' if keepalive else 'off'})")
+    print(f"Workers: {concurrency}")
+    print(f"Requests: {completed} ok, {errors} failed in {elapsed:.3f}s")
+    print(f"Throughput: {completed / elapsed if elapsed > 0 else 0.0:.1f} req/s")
+    print(
+        "Latency (ms): "
+        f"p50={percentile(latencies, 0.50) * 1e3:.3f} "
+        f"p90={percentile(latencies, 0.90) * 1e3:.3f} "
+        f"p99={percentile(latencies, 0.99) * 1e3:.3f} "
+        f"max={(latencies[-1] if latencies else 0.0) * 1e3:.3f}"
+    )
+    if verify:
+        print(f"Integrity: {sum(w.corrupt for w in workers)} bodies missing or failing X-Body-Sha256")
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(description=__doc__, formatter_class=argparse.RawDescriptionHelpFormatter)
+    parser.add_argument("--url", default="http://localhost:8000/", help="target URL")
+    parser.add_argument("-c", "--concurrency", type=int, default=8, help="number of concurrent workers")
+    limit = parser.add_mutually_exclusive_group()
+    limit.add_argument("-n", "--requests", type=int, help="total requests across all workers (default 10000)")
+    limit.add_argument("-d", "--duration", type=float, help="run for this many seconds instead of a fixed count")
+    parser.add_argument(
+        "--transport", choices=["rust", "httpx"], default="rust", help="transport to drive (httpx is the pure-Python default)"
+    )
+    parser.add_argument(
+        "--no-keepalive", dest="keepalive", action="store_false", help="open a new connection for every request"
+    )
+    parser.add_argument(
+        "--verify", action="store_true", help="check each body against the server's X-Body-Sha256 header"
+    )
+    parser.add_argument(
+        "--prime", action="store_true", help="open each worker's connection via /prime before the timed phase"
+    )
+    args = parser.parse_args()
+
+    if args.concurrency < 1:
+        parser.error("--concurrency must be at least 1")
+    if args.requests is None and args.duration is None:
+        args.requests = 10000
+    run_load(args.url, args.concurrency, args.requests, args.duration, args.transport, args.keepalive, args.verify, args.prime)
+
+
+if __name__ == "__main__":
+    main()
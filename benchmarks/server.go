@@ -1,20 +1,3410 @@
 package main
 
 import (
+    "bufio"
+    "compress/gzip"
+    "compress/zlib"
+    "context"
+    crand "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
     "fmt"
+    "hash/crc32"
+    "io"
+    "log"
+    "math/bits"
+    "math/rand/v2"
+    "net"
     "net/http"
+    "net/netip"
+    "net/url"
+    "os"
+    "os/signal"
+    "path"
+    "path/filepath"
+    "runtime"
+    "runtime/debug"
+    "runtime/pprof"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "github.com/andybalholm/brotli"
+    "github.com/klauspost/compress/zstd"
+)
+
+// bodyPattern is repeated to fill generated bodies, so byte i of any body is
+// bodyPattern[i%len(bodyPattern)] and clients can verify integrity cheaply.
+const bodyPattern = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_"
+
+type config struct {
+    addrs             []string
+    unixSocket        string
+    noDelay           bool
+    reusePort         bool
+    backlog           int
+    proxyProtocol     bool
+    shutdownTimeout   time.Duration
+    drainDelay        time.Duration
+    warmup            time.Duration
+    readTimeout       time.Duration
+    readHeaderTimeout time.Duration
+    writeTimeout      time.Duration
+    idleTimeout       time.Duration
+    maxHeaderBytes    int
+    proto             string
+    certFile          string
+    keyFile           string
+    clientCAFile      string
+    tlsResumption     string
+    verbose           bool
+    connLog           bool
+    keepAlive         bool
+    http10            bool
+    logFormat         string
+    maxUpload         int64
+    maxConcurrent     int
+    queueTimeout      time.Duration
+    retryAfter        int
+    bodySize          int
+    chunked           bool
+    chunkSize         int
+    delay             time.Duration
+    jitter            time.Duration
+    defaultWork       time.Duration
+    defaultAlloc      int
+    compress          bool
+    seed              uint64
+    rate              int64
+    serverTiming      bool
+    fuzzRate          float64
+    fuzzKinds         string
+    metrics           bool
+    sequence          string
+    staticDir         string
+    genFiles          bool
+    extraHeaders      string
+    vhosts            string
+}
+
+type server struct {
+    cfg  config
+    body []byte
+    // patternBuf holds whole repetitions of bodyPattern and is used to write
+    // dynamically sized bodies without allocating per request.
+    patternBuf []byte
+    latency    *histogram
+    // slots bounds concurrent requests when -max-concurrent is set.
+    slots chan struct{}
+    // metrics is nil when -metrics=false.
+    metrics *metrics
+    seq     *sequence
+    // routeStats holds a counter set per pattern registered by routes; it
+    // is only appended to while the router is built.
+    routeStats []*routeStats
+    // started is the Last-Modified time of generated bodies and the start
+    // of the -warmup period.
+    started time.Time
+    // draining is set once graceful shutdown begins.
+    draining atomic.Bool
+    // conns counts connections that have served a request, and primedConns
+    // those among them that called /prime.
+    conns       atomic.Uint64
+    primedConns atomic.Uint64
+    // extra holds the -extra-headers added to every response.
+    extra http.Header
+    // vhosts maps lower-cased -vhosts hostnames to their root bodies.
+    vhosts map[string][]byte
+    // fuzz holds the -fuzz-kinds malformations picked from at random.
+    fuzz []malformation
+    // bodySums and randomSums cache the SHA-256 of the patterned and seeded
+    // /random bodies by size, and fileSums that of the current version of
+    // each static file by its cleaned path.
+    bodySums   digestCache
+    randomSums digestCache
+    fileMu     sync.Mutex
+    fileSums   map[string]*fileDigest
+    // bodySha256 is the hex SHA-256 of body, sent as X-Body-Sha256.
+    bodySha256 string
+}
+
+func newServer(cfg config) (*server, error) {
+    s := &server{
+        cfg:     cfg,
+        body:    []byte("Hello, World!"),
+        latency: newHistogram(),
+        started: time.Now(),
+    }
+    if cfg.bodySize > 0 {
+        s.body = fillBody(cfg.bodySize)
+    }
+    sum := sha256.Sum256(s.body)
+    s.bodySha256 = hex.EncodeToString(sum[:])
+    s.patternBuf = fillBody(len(bodyPattern) * 512)
+    if cfg.maxConcurrent > 0 {
+        s.slots = make(chan struct{}, cfg.maxConcurrent)
+    }
+    if cfg.metrics {
+        s.metrics = &metrics{}
+    }
+    var err error
+    if s.seq, err = newSequence(cfg.sequence); err != nil {
+        return nil, err
+    }
+    if s.extra, err = parseHeaderList(cfg.extraHeaders); err != nil {
+        return nil, err
+    }
+    if s.vhosts, err = parseVhosts(cfg.vhosts); err != nil {
+        return nil, err
+    }
+    if s.fuzz, err = parseMalformations(cfg.fuzzKinds); err != nil {
+        return nil, err
+    }
+    if cfg.staticDir != "" {
+        s.hashStaticFiles()
+    }
+    return s, nil
+}
+
+func fillBody(n int) []byte {
+    b := make([]byte, n)
+    for i := range b {
+        b[i] = bodyPattern[i%len(bodyPattern)]
+    }
+    return b
+}
+
+// routes builds the request router.
+//
+// Over HTTP/1.1, net/http serves pipelined requests on a connection strictly
+// in order: the next request is read only after the previous response has
+// been written in full, so pipelined responses are never reordered or
+// interleaved, and a slow response delays everything queued behind it.
+func (s *server) routes() *http.ServeMux {
+    mux := http.NewServeMux()
+    handle := func(pattern string, h http.HandlerFunc) {
+        rs := &routeStats{route: pattern}
+        s.routeStats = append(s.routeStats, rs)
+        mux.Handle(pattern, rs.count(s.timed(s.serverTiming(s.virtualHosts(s.limited(s.delayed(s.allocating(s.working(s.fuzzed(h))))))))))
+    }
+    handle("/", s.handler)
+    handle("/echo/{size}", s.handleEcho)
+    handle("/random/{size}", s.handleRandom)
+    handle("/status/{code}", s.handleStatus)
+    handle("/flaky", s.handleFlaky)
+    handle("/truncate", s.handleTruncate)
+    handle("/close", s.handleClose)
+    handle("/goaway", s.handleClose)
+    handle("/reset", s.handleReset)
+    handle("/reset-mid", s.handleResetMid)
+    handle("/stream-close", s.handleStreamClose)
+    handle("/redirect", s.handleRedirect)
+    handle("/setcookie", s.handleSetCookie)
+    handle("/cookies", s.handleCookies)
+    handle("/work", s.handleWork)
+    handle("/alloc", s.handleAlloc)
+    handle("/upload", s.handleUpload)
+    handle("/echo-body", s.handleEchoBody)
+    handle("/whoami", s.handleWhoami)
+    handle("/tlsinfo", s.handleTLSInfo)
+    handle("/trickle", s.handleTrickle)
+    handle("/trailers", s.handleTrailers)
+    handle("/expect", s.handleExpect)
+    handle("/headers", s.handleHeaders)
+    handle("/bigheaders", s.handleBigHeaders)
+    handle("/sequence", s.handleSequence)
+    handle("/ws", s.handleWebSocket)
+    handle("/sse", s.handleSSE)
+    mux.HandleFunc("/sequence/reset", s.handleSequenceReset)
+    if s.cfg.staticDir != "" {
+        handle("/static/", http.StripPrefix("/static", s.staticFiles()).ServeHTTP)
+    }
+    mux.HandleFunc("/healthz", s.handleHealthz)
+    mux.HandleFunc("/readyz", s.handleReadyz)
+    mux.HandleFunc("/stats", s.handleStats)
+    mux.HandleFunc("/prime", s.handlePrime)
+    mux.HandleFunc("/stats/routes", s.handleRouteStats)
+    if s.metrics != nil {
+        mux.HandleFunc("/metrics", s.metrics.handle)
+    }
+    return mux
+}
+
+// timed records the time spent in next into the latency histogram.
+func (s *server) timed(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        next.ServeHTTP(w, r)
+        s.latency.record(time.Since(start))
+    })
+}
+
+type phaseTimesKey struct{}
+
+// phaseTimes records when a request arrived and when it was admitted past
+// -max-concurrent, for the Server-Timing header.
+type phaseTimes struct {
+    start    time.Time
+    admitted time.Time
+}
+
+// serverTiming reports, with -server-timing, how long the request spent in
+// each server phase: queue (waiting for a -max-concurrent slot), proc (from
+// admission to the status line, including any -delay) and body (writing the
+// body). The first two go in the Server-Timing header; body is only known
+// at the end, so it is sent as a Server-Timing trailer, which clients only
+// receive on chunked and HTTP/2 responses.
+func (s *server) serverTiming(next http.Handler) http.Handler {
+    if !s.cfg.serverTiming {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        now := time.Now()
+        t := &phaseTimes{start: now, admitted: now}
+        tw := &timingWriter{ResponseWriter: w, times: t}
+        next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), phaseTimesKey{}, t)))
+        if !tw.headerAt.IsZero() {
+            w.Header().Set(http.TrailerPrefix+"Server-Timing", fmt.Sprintf("body;dur=%s", millis(time.Since(tw.headerAt))))
+        }
+    })
+}
+
+// millis formats d as fractional milliseconds.
+func millis(d time.Duration) string {
+    return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// timingWriter adds the Server-Timing header just before the status line.
+type timingWriter struct {
+    http.ResponseWriter
+    times    *phaseTimes
+    headerAt time.Time
+}
+
+func (tw *timingWriter) WriteHeader(code int) {
+    if tw.headerAt.IsZero() && code >= 200 {
+        tw.headerAt = time.Now()
+        tw.Header().Set("Server-Timing", fmt.Sprintf("queue;dur=%s, proc;dur=%s",
+            millis(tw.times.admitted.Sub(tw.times.start)), millis(tw.headerAt.Sub(tw.times.admitted))))
+    }
+    tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timingWriter) Write(p []byte) (int, error) {
+    if tw.headerAt.IsZero() {
+        tw.WriteHeader(http.StatusOK)
+    }
+    return tw.ResponseWriter.Write(p)
+}
+
+func (tw *timingWriter) Flush() {
+    flush(tw.ResponseWriter)
+}
+
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+    return tw.ResponseWriter
+}
+
+// limited admits at most -max-concurrent requests at once. A request that
+// cannot get a slot within -queue-timeout is rejected with 503 and a
+// Retry-After header; a request cancelled while queued gives up its place.
+func (s *server) limited(next http.Handler) http.Handler {
+    if s.slots == nil {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !s.acquire(r.Context()) {
+            if r.Context().Err() != nil {
+                return
+            }
+            w.Header().Set("Retry-After", strconv.Itoa(s.cfg.retryAfter))
+            http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+            return
+        }
+        defer func() { <-s.slots }()
+        if t, ok := r.Context().Value(phaseTimesKey{}).(*phaseTimes); ok {
+            t.admitted = time.Now()
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (s *server) acquire(ctx context.Context) bool {
+    select {
+    case s.slots <- struct{}{}:
+        return true
+    default:
+    }
+    if s.cfg.queueTimeout <= 0 {
+        return false
+    }
+    t := time.NewTimer(s.cfg.queueTimeout)
+    defer t.Stop()
+    select {
+    case s.slots <- struct{}{}:
+        return true
+    case <-t.C:
+        return false
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// delayed sleeps for -delay plus up to -jitter (or the request's ?delay=
+// value, which replaces both) before calling next. The delay happens before
+// the status line is written, so clients observe it as time-to-first-byte.
+// The sleep is abandoned if the request context is cancelled.
+func (s *server) delayed(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        d := s.cfg.delay
+        if s.cfg.jitter > 0 {
+            d += rand.N(s.cfg.jitter)
+        }
+        if v := r.URL.Query().Get("delay"); v != "" {
+            var err error
+            if d, err = time.ParseDuration(v); err != nil || d < 0 {
+                http.Error(w, "invalid delay", http.StatusBadRequest)
+                return
+            }
+        }
+        if !sleepCtx(r.Context(), d) {
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// working burns -default-work of CPU on every request before calling next,
+// after any -delay, so the work holds a -max-concurrent slot like a real
+// CPU-bound backend would.
+func (s *server) working(next http.Handler) http.Handler {
+    if s.cfg.defaultWork <= 0 {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !busyWork(r.Context(), s.cfg.defaultWork) {
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// handleWork burns ?ms= (default 50) milliseconds of CPU, on top of any
+// -default-work, and then serves the default body.
+func (s *server) handleWork(w http.ResponseWriter, r *http.Request) {
+    ms, ok := queryInt(w, r, "ms", 50)
+    if !ok {
+        return
+    }
+    if !busyWork(r.Context(), time.Duration(ms)*time.Millisecond) {
+        return
+    }
+    s.writeBody(w, s.body)
+}
+
+// busyWork hashes in a loop for roughly d of wall-clock time, keeping one
+// core busy, and reports whether it finished before ctx was cancelled.
+func busyWork(ctx context.Context, d time.Duration) bool {
+    var sum [sha256.Size]byte
+    deadline := time.Now().Add(d)
+    for time.Now().Before(deadline) {
+        for range 64 {
+            sum = sha256.Sum256(sum[:])
+        }
+        if ctx.Err() != nil {
+            return false
+        }
+    }
+    return true
+}
+
+// maxAllocMB caps a single request's /alloc or -default-alloc allocation.
+const maxAllocMB = 1024
+
+// allocating holds -default-alloc MiB of freshly allocated memory for the
+// whole of every request, so that heap growth and GC pauses scale with
+// load. The memory becomes garbage as soon as the request completes.
+func (s *server) allocating(next http.Handler) http.Handler {
+    if s.cfg.defaultAlloc <= 0 {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        buf := allocate(s.cfg.defaultAlloc)
+        next.ServeHTTP(w, r)
+        runtime.KeepAlive(buf)
+    })
+}
+
+// handleAlloc allocates ?mb= MiB (default 10, at most maxAllocMB), keeps
+// it live for ?hold= (default 10ms) and while the default body is written,
+// then lets it go.
+func (s *server) handleAlloc(w http.ResponseWriter, r *http.Request) {
+    mb, ok := queryInt(w, r, "mb", 10)
+    if !ok {
+        return
+    }
+    if mb > maxAllocMB {
+        http.Error(w, "mb must be at most "+strconv.Itoa(maxAllocMB), http.StatusBadRequest)
+        return
+    }
+    hold, ok := queryDuration(w, r, "hold", 10*time.Millisecond)
+    if !ok {
+        return
+    }
+    buf := allocate(mb)
+    if sleepCtx(r.Context(), hold) {
+        s.writeBody(w, s.body)
+    }
+    runtime.KeepAlive(buf)
+}
+
+// allocate returns mb MiB of heap memory with every page written, so it is
+// backed by real memory rather than untouched zero pages.
+func allocate(mb int) []byte {
+    buf := make([]byte, mb<<20)
+    for i := 0; i < len(buf); i += 4096 {
+        buf[i] = 1
+    }
+    return buf
+}
+
+// sleepCtx sleeps for d and reports whether it completed before ctx was
+// cancelled.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+    if d <= 0 {
+        return ctx.Err() == nil
+    }
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-t.C:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// handleHealthz reports that the server is up.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports 503 until -warmup has elapsed since startup and again
+// once graceful shutdown has begun, and 200 in between.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+    switch {
+    case s.draining.Load():
+        http.Error(w, "draining", http.StatusServiceUnavailable)
+    case time.Since(s.started) < s.cfg.warmup:
+        http.Error(w, "warming up", http.StatusServiceUnavailable)
+    default:
+        w.Write([]byte("ready\n"))
+    }
+}
+
+// handleStats reports the handler latency histogram; ?reset=1 clears it
+// after the snapshot is taken.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+    snap := statsSnapshot{
+        histogramSnapshot: s.latency.snapshot(),
+        Connections:       s.conns.Load(),
+        PrimedConnections: s.primedConns.Load(),
+    }
+    if r.URL.Query().Get("reset") == "1" {
+        s.latency.reset()
+    }
+    writeJSON(w, http.StatusOK, snap)
+}
+
+// statsSnapshot is the /stats response. The connection counts are totals
+// since startup and are not cleared by ?reset=1, since a connection is
+// counted only once.
+type statsSnapshot struct {
+    histogramSnapshot
+    Connections       uint64 `json:"connections"`
+    PrimedConnections uint64 `json:"primed_connections"`
+}
+
+// stack wraps the routes in the middleware selected by the flags. accessLog
+// may be nil.
+func (s *server) stack(accessLog *accessLogger) http.Handler {
+    var h http.Handler = s.routes()
+    if s.cfg.compress {
+        h = compressResponses(h)
+    }
+    h = s.throttle(h)
+    if len(s.extra) > 0 {
+        h = addHeaders(s.extra, h)
+    }
+    if len(s.cfg.addrs) > 1 && s.cfg.unixSocket == "" {
+        h = tagListenerPort(h)
+    }
+    if !s.cfg.keepAlive {
+        h = closeConnections(h)
+    }
+    if s.cfg.verbose {
+        h = logProtocol(h)
+    }
+    if accessLog != nil {
+        h = accessLog.middleware(h)
+    }
+    if s.metrics != nil {
+        h = s.metrics.middleware(h)
+    }
+    h = requestIDs(h)
+    h = s.countConnections(h)
+    if s.cfg.http10 {
+        h = http10Responses(h)
+    }
+    return h
+}
+
+// countConnections counts each connection once, on its first request. For
+// TLS that is after the handshake, so the count is of connections a client
+// has fully set up.
+func (s *server) countConnections(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && !ci.served.Load() && ci.served.CompareAndSwap(false, true) {
+            s.conns.Add(1)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// handlePrime answers 204 at once. Clients call it from each worker before
+// a timed run so that connection and TLS setup are done up front; /stats
+// then reports how many distinct connections were primed.
+func (s *server) handlePrime(w http.ResponseWriter, r *http.Request) {
+    if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && ci.primed.CompareAndSwap(false, true) {
+        s.primedConns.Add(1)
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// routeStats counts the requests served by one route. Error counts are by
+// response status class; bytes is response body bytes written.
+type routeStats struct {
+    route     string
+    requests  atomic.Int64
+    errors4xx atomic.Int64
+    errors5xx atomic.Int64
+    bytes     atomic.Int64
+}
+
+type routeSnapshot struct {
+    Requests  int64 `json:"requests"`
+    Errors4xx int64 `json:"errors_4xx"`
+    Errors5xx int64 `json:"errors_5xx"`
+    Bytes     int64 `json:"bytes"`
+}
+
+func (rs *routeStats) count(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rw := &responseRecorder{ResponseWriter: w}
+        defer func() {
+            rs.requests.Add(1)
+            switch {
+            case rw.status >= 500:
+                rs.errors5xx.Add(1)
+            case rw.status >= 400:
+                rs.errors4xx.Add(1)
+            }
+            rs.bytes.Add(rw.bytes)
+        }()
+        next.ServeHTTP(rw, r)
+    })
+}
+
+// handleRouteStats reports per-route counters keyed by route pattern.
+// ?reset=1 zeroes them after the snapshot is taken.
+func (s *server) handleRouteStats(w http.ResponseWriter, r *http.Request) {
+    reset := r.URL.Query().Get("reset") == "1"
+    snap := make(map[string]routeSnapshot, len(s.routeStats))
+    for _, rs := range s.routeStats {
+        if reset {
+            snap[rs.route] = routeSnapshot{
+                Requests:  rs.requests.Swap(0),
+                Errors4xx: rs.errors4xx.Swap(0),
+                Errors5xx: rs.errors5xx.Swap(0),
+                Bytes:     rs.bytes.Swap(0),
+            }
+            continue
+        }
+        snap[rs.route] = routeSnapshot{
+            Requests:  rs.requests.Load(),
+            Errors4xx: rs.errors4xx.Load(),
+            Errors5xx: rs.errors5xx.Load(),
+            Bytes:     rs.bytes.Load(),
+        }
+    }
+    writeJSON(w, http.StatusOK, snap)
+}
+
+func (s *server) handler(w http.ResponseWriter, r *http.Request) {
+    if body, ok := r.Context().Value(vhostBodyKey{}).([]byte); ok && r.URL.Path == "/" {
+        s.writeBody(w, body)
+        return
+    }
+    w.Header().Set("X-Body-Sha256", s.bodySha256)
+    s.writeBody(w, s.body)
+}
+
+// handleEcho returns a generated body of the size given in the path.
+func (s *server) handleEcho(w http.ResponseWriter, r *http.Request) {
+    size, ok := pathSize(w, r)
+    if !ok {
+        return
+    }
+    whole := s.cfg.bodySize > 0 && size == len(s.body)
+    summed := true
+    if whole {
+        w.Header().Set("X-Body-Sha256", s.bodySha256)
+    } else if sum, ok := s.bodySum(size); ok {
+        w.Header().Set("X-Body-Sha256", hex.EncodeToString(sum[:]))
+    } else {
+        summed = false
+    }
+    if notModified(w, r, patternETag(size), s.started) {
+        return
+    }
+    switch {
+    case whole:
+        s.writeBody(w, s.body)
+    case summed:
+        s.writeStream(w, size, s.pattern)
+    default:
+        s.writeDigested(w, size, s.pattern)
+    }
+}
+
+// pattern returns up to n bytes of the patterned body starting at off.
+func (s *server) pattern(off, n int) []byte {
+    start := off % len(bodyPattern)
+    n = min(n, len(s.patternBuf)-start)
+    return s.patternBuf[start : start+n]
+}
+
+// patternETag is the ETag of the size-byte patterned body, which depends on
+// nothing but its size.
+func patternETag(size int) string {
+    return `"pattern-` + strconv.Itoa(size) + `"`
+}
+
+// maxHeaderDigest is the largest generated body whose X-Body-Sha256 is sent
+// as a header, which means hashing it before the status line; larger bodies
+// are hashed as they are written and get it as a trailer. maxCachedDigests
+// bounds each digestCache.
+const (
+    maxHeaderDigest  = 1 << 20
+    maxCachedDigests = 1024
+)
+
+// digestCache holds body digests by size. When full, an arbitrary entry is
+// evicted to make room.
+type digestCache struct {
+    mu   sync.Mutex
+    sums map[int][32]byte
+}
+
+// get returns the digest for size, calling compute on a miss.
+func (c *digestCache) get(size int, compute func() [32]byte) [32]byte {
+    c.mu.Lock()
+    sum, ok := c.sums[size]
+    c.mu.Unlock()
+    if ok {
+        return sum
+    }
+    sum = compute()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.sums == nil {
+        c.sums = make(map[int][32]byte)
+    }
+    if len(c.sums) >= maxCachedDigests {
+        for k := range c.sums {
+            delete(c.sums, k)
+            break
+        }
+    }
+    c.sums[size] = sum
+    return sum
+}
+
+// bodySum returns the SHA-256 of the size-byte patterned body, or false if
+// the body is too large to hash before the headers.
+func (s *server) bodySum(size int) ([32]byte, bool) {
+    if size > maxHeaderDigest {
+        return [32]byte{}, false
+    }
+    return s.bodySums.get(size, func() [32]byte {
+        h := sha256.New()
+        for off := 0; off < size; {
+            p := s.pattern(off, size-off)
+            h.Write(p)
+            off += len(p)
+        }
+        var sum [32]byte
+        h.Sum(sum[:0])
+        return sum
+    }), true
+}
+
+// writeDigested is writeStream with the body's SHA-256 computed as it is
+// written and sent as an X-Body-Sha256 trailer.
+func (s *server) writeDigested(w http.ResponseWriter, size int, next func(off, n int) []byte) {
+    h := sha256.New()
+    w.Header().Set("Trailer", "X-Body-Sha256")
+    s.writeStream(w, size, func(off, n int) []byte {
+        p := next(off, n)
+        h.Write(p)
+        return p
+    })
+    w.Header().Set("X-Body-Sha256", hex.EncodeToString(h.Sum(nil)))
+}
+
+// randomSeed returns the ChaCha8 seed for a /random body: derived from
+// -seed when set, otherwise fresh for each call.
+func (s *server) randomSeed() [32]byte {
+    var seed [32]byte
+    if s.cfg.seed != 0 {
+        binary.LittleEndian.PutUint64(seed[:], s.cfg.seed)
+        return seed
+    }
+    for i := 0; i < len(seed); i += 8 {
+        binary.LittleEndian.PutUint64(seed[i:], rand.Uint64())
+    }
+    return seed
+}
+
+// randomSum returns the SHA-256 of the size-byte seeded /random body, or
+// false if the body is too large to hash before the headers.
+func (s *server) randomSum(size int) ([32]byte, bool) {
+    if size > maxHeaderDigest {
+        return [32]byte{}, false
+    }
+    return s.randomSums.get(size, func() [32]byte {
+        rng := rand.NewChaCha8(s.randomSeed())
+        buf := copyBufPool.Get().(*[32 << 10]byte)
+        defer copyBufPool.Put(buf)
+        h := sha256.New()
+        for off := 0; off < size; {
+            p := buf[:min(len(buf), size-off)]
+            rng.Read(p)
+            h.Write(p)
+            off += len(p)
+        }
+        var sum [32]byte
+        h.Sum(sum[:0])
+        return sum
+    }), true
+}
+
+// fileKey identifies a version of a static file.
+type fileKey struct {
+    name    string
+    size    int64
+    modTime time.Time
+}
+
+// staticFiles serves -static-dir with a strong ETag computed over each
+// file's contents, so http.FileServer can answer If-None-Match and If-Range
+// as well as the If-Modified-Since checks it does from the file's mtime.
+func (s *server) staticFiles() http.Handler {
+    root := http.Dir(s.cfg.staticDir)
+    fs := http.FileServer(root)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if sum, ok := s.fileSum(root, r.URL.Path); ok {
+            w.Header().Set("ETag", etag(sum))
+        }
+        fs.ServeHTTP(w, r)
+    })
+}
+
+// fileDigest is the SHA-256 of one version of a static file. The first
+// request to need it computes it and closes done; concurrent requests for the
+// same version wait on done instead of hashing the file again.
+type fileDigest struct {
+    key  fileKey
+    done chan struct{}
+    sum  [32]byte
+    ok   bool
+}
+
+// hashStaticFiles computes the digest of every file under -static-dir, so
+// that requests only hash files added or changed after startup.
+func (s *server) hashStaticFiles() {
+    root := http.Dir(s.cfg.staticDir)
+    filepath.WalkDir(s.cfg.staticDir, func(p string, d os.DirEntry, err error) error {
+        if err != nil || !d.Type().IsRegular() {
+            return nil
+        }
+        if rel, err := filepath.Rel(s.cfg.staticDir, p); err == nil {
+            s.fileSum(root, "/"+filepath.ToSlash(rel))
+        }
+        return nil
+    })
+}
+
+func (s *server) fileSum(root http.Dir, name string) ([32]byte, bool) {
+    name = path.Clean("/" + name)
+    f, err := root.Open(name)
+    if err != nil {
+        return [32]byte{}, false
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil || fi.IsDir() {
+        return [32]byte{}, false
+    }
+    key := fileKey{name, fi.Size(), fi.ModTime()}
+    s.fileMu.Lock()
+    d, ok := s.fileSums[name]
+    if ok && d.key == key {
+        s.fileMu.Unlock()
+        <-d.done
+        return d.sum, d.ok
+    }
+    d = &fileDigest{key: key, done: make(chan struct{})}
+    if s.fileSums == nil {
+        s.fileSums = make(map[string]*fileDigest)
+    }
+    s.fileSums[name] = d
+    s.fileMu.Unlock()
+
+    h := sha256.New()
+    if _, err := copyBody(h, f); err == nil {
+        h.Sum(d.sum[:0])
+        d.ok = true
+    } else {
+        // Let the next request retry rather than caching the failure.
+        s.fileMu.Lock()
+        if s.fileSums[name] == d {
+            delete(s.fileSums, name)
+        }
+        s.fileMu.Unlock()
+    }
+    close(d.done)
+    return d.sum, d.ok
+}
+
+func etag(sum [32]byte) string {
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified sets the ETag and Last-Modified validators and answers 304 if
+// the request's If-None-Match, or failing that If-Modified-Since, shows the
+// client already has this representation.
+func notModified(w http.ResponseWriter, r *http.Request, tag string, modTime time.Time) bool {
+    w.Header().Set("ETag", tag)
+    w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        return false
+    }
+    match := false
+    if inm := r.Header.Get("If-None-Match"); inm != "" {
+        for t := range strings.SplitSeq(inm, ",") {
+            t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+            if t == "*" || t == tag {
+                match = true
+                break
+            }
+        }
+    } else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+        match = !modTime.Truncate(time.Second).After(ims)
+    }
+    if match {
+        w.WriteHeader(http.StatusNotModified)
+    }
+    return match
+}
+
+// handleRandom returns the number of random bytes given in the path. The
+// body is incompressible, for comparison against the patterned /echo body.
+// With -seed every request for a size gets the same bytes and an
+// X-Body-Sha256 header (a trailer above maxHeaderDigest); without it the
+// bytes differ on every request and the digest, known only once the body is
+// written, is always sent as a trailer.
+func (s *server) handleRandom(w http.ResponseWriter, r *http.Request) {
+    size, ok := pathSize(w, r)
+    if !ok {
+        return
+    }
+    digested := true
+    if s.cfg.seed != 0 {
+        if sum, ok := s.randomSum(size); ok {
+            w.Header().Set("X-Body-Sha256", hex.EncodeToString(sum[:]))
+            digested = false
+        }
+    }
+    rng := rand.NewChaCha8(s.randomSeed())
+    buf := copyBufPool.Get().(*[32 << 10]byte)
+    defer copyBufPool.Put(buf)
+    w.Header().Set("Content-Type", "application/octet-stream")
+    next := func(off, n int) []byte {
+        p := buf[:min(n, len(buf))]
+        rng.Read(p)
+        return p
+    }
+    if digested {
+        s.writeDigested(w, size, next)
+        return
+    }
+    s.writeStream(w, size, next)
+}
+
+// handleExpect handles Expect: 100-continue explicitly. With ?reject=1 it
+// answers 417 without reading the body, so a well-behaved client never sends
+// it; otherwise it writes 100 Continue itself (HTTP/1.1 only, as HTTP/1.0
+// has no 1xx responses) before draining the body and reporting its size. Any
+// -delay or ?delay= is applied before the 100 is sent, which exercises how
+// long the client waits for it.
+func (s *server) handleExpect(w http.ResponseWriter, r *http.Request) {
+    expect := strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+    if expect && r.URL.Query().Get("reject") == "1" {
+        w.Header().Set("Connection", "close")
+        http.Error(w, http.StatusText(http.StatusExpectationFailed), http.StatusExpectationFailed)
+        return
+    }
+    if expect && r.ProtoAtLeast(1, 1) {
+        w.WriteHeader(http.StatusContinue)
+    }
+    n, err := copyBody(io.Discard, r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"bytes": n, "continued": expect})
+}
+
+// handleHeaders returns the received request headers as a JSON object. Each
+// header maps to all of its values so duplicates stay visible; Host is
+// reported separately because net/http removes it from the header map.
+func (s *server) handleHeaders(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]any{"host": r.Host, "headers": r.Header})
+}
+
+// sequence replays a fixed list of status codes to each client, repeating
+// the last one once the list is exhausted.
+type sequence struct {
+    codes []int
+
+    mu   sync.Mutex
+    next map[string]int // position per client key
+}
+
+func newSequence(spec string) (*sequence, error) {
+    seq := &sequence{next: make(map[string]int)}
+    for part := range strings.SplitSeq(spec, ",") {
+        code, err := strconv.Atoi(strings.TrimSpace(part))
+        if err != nil || code < 200 || code > 599 {
+            return nil, fmt.Errorf("invalid -sequence status %q", part)
+        }
+        seq.codes = append(seq.codes, code)
+    }
+    return seq, nil
+}
+
+// step returns the zero-based step and the status code to send for key.
+func (seq *sequence) step(key string) (int, int) {
+    seq.mu.Lock()
+    defer seq.mu.Unlock()
+    i := seq.next[key]
+    if i < len(seq.codes)-1 {
+        seq.next[key] = i + 1
+    }
+    return i, seq.codes[i]
+}
+
+func (seq *sequence) reset(key string) {
+    seq.mu.Lock()
+    defer seq.mu.Unlock()
+    if key == "" {
+        clear(seq.next)
+        return
+    }
+    delete(seq.next, key)
+}
+
+// sequenceKey identifies the client a /sequence request belongs to: the
+// X-Sequence-Key header if present, otherwise the client IP.
+func sequenceKey(r *http.Request) string {
+    if k := r.Header.Get("X-Sequence-Key"); k != "" {
+        return k
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// handleSequence responds with the client's next status from -sequence.
+func (s *server) handleSequence(w http.ResponseWriter, r *http.Request) {
+    i, code := s.seq.step(sequenceKey(r))
+    w.Header().Set("X-Sequence-Step", strconv.Itoa(i))
+    if code >= 200 && code < 300 {
+        w.WriteHeader(code)
+        w.Write(s.body)
+        return
+    }
+    http.Error(w, http.StatusText(code), code)
+}
+
+// handleSequenceReset rewinds the sequence for the X-Sequence-Key or ?key=
+// client, or for every client if neither is given.
+func (s *server) handleSequenceReset(w http.ResponseWriter, r *http.Request) {
+    key := r.Header.Get("X-Sequence-Key")
+    if v := r.URL.Query().Get("key"); v != "" {
+        key = v
+    }
+    s.seq.reset(key)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSSE streams ?count= server-sent events (default 10, 0 for no limit)
+// every ?interval= (default 1s), flushing each one as it is written. The
+// stream ends early when the client disconnects.
+func (s *server) handleSSE(w http.ResponseWriter, r *http.Request) {
+    count, ok := queryInt(w, r, "count", 10)
+    if !ok {
+        return
+    }
+    interval, ok := queryDuration(w, r, "interval", time.Second)
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+    flush(w)
+    for i := 0; count == 0 || i < count; i++ {
+        if i > 0 && !sleepCtx(r.Context(), interval) {
+            return
+        }
+        if _, err := fmt.Fprintf(w, "id: %d\ndata: event %d at %s\n\n", i, i, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+            return
+        }
+        flush(w)
+    }
+}
+
+// websocketGUID is appended to Sec-WebSocket-Key to form the accept hash
+// (RFC 6455 section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketPayload bounds a single frame; larger frames close the
+// connection with status 1009.
+const maxWebSocketPayload = 16 << 20
+
+// handleWebSocket performs the RFC 6455 upgrade handshake over HTTP/1.1 and
+// then echoes every data frame back to the client. An upgrade request
+// missing any required header is declined with 400.
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if r.ProtoMajor != 1 || r.Method != http.MethodGet ||
+        !headerHasToken(r.Header, "Connection", "upgrade") ||
+        !headerHasToken(r.Header, "Upgrade", "websocket") ||
+        r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "not a valid websocket upgrade request", http.StatusBadRequest)
+        return
+    }
+    conn, brw, err := http.NewResponseController(w).Hijack()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer conn.Close()
+    // Clear the upgrade request's -read-timeout and -write-timeout deadlines
+    // so they cannot cut the echo session off. Recent net/http releases do
+    // this on Hijack too; doing it here does not depend on that.
+    conn.SetDeadline(time.Time{})
+    sum := sha1.Sum([]byte(key + websocketGUID))
+    fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+        base64.StdEncoding.EncodeToString(sum[:]))
+    if err := brw.Flush(); err != nil {
+        return
+    }
+    websocketEcho(brw)
+}
+
+// headerHasToken reports whether the comma-separated header contains token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for t := range strings.SplitSeq(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// WebSocket opcodes and close codes used by the echo loop.
+const (
+    wsOpContinuation = 0x0
+    wsOpText         = 0x1
+    wsOpBinary       = 0x2
+    wsOpClose        = 0x8
+    wsOpPing         = 0x9
+    wsOpPong         = 0xa
+
+    wsCloseProtocolError = 1002
+    wsCloseTooBig        = 1009
+)
+
+// websocketEcho echoes data frames with their original opcode and FIN bit,
+// answers pings with pongs and returns after completing the close handshake.
+func websocketEcho(brw *bufio.ReadWriter) {
+    for {
+        fin, op, payload, err := readWebSocketFrame(brw.Reader)
+        if err != nil {
+            var we wsError
+            if errors.As(err, &we) {
+                writeWebSocketClose(brw.Writer, we.code)
+                brw.Flush()
+            }
+            return
+        }
+        switch op {
+        case wsOpContinuation, wsOpText, wsOpBinary:
+            writeWebSocketFrame(brw.Writer, fin, op, payload)
+        case wsOpPing:
+            writeWebSocketFrame(brw.Writer, true, wsOpPong, payload)
+        case wsOpPong:
+            continue
+        case wsOpClose:
+            writeWebSocketFrame(brw.Writer, true, wsOpClose, payload)
+            brw.Flush()
+            return
+        default:
+            writeWebSocketClose(brw.Writer, wsCloseProtocolError)
+            brw.Flush()
+            return
+        }
+        if err := brw.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+// wsError is a protocol violation that closes the connection with code.
+type wsError struct{ code uint16 }
+
+func (e wsError) Error() string { return fmt.Sprintf("websocket protocol error %d", e.code) }
+
+func readWebSocketFrame(r *bufio.Reader) (fin bool, op byte, payload []byte, err error) {
+    var hdr [2]byte
+    if _, err = io.ReadFull(r, hdr[:]); err != nil {
+        return
+    }
+    fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+    masked := hdr[1]&0x80 != 0
+    n := uint64(hdr[1] & 0x7f)
+    switch n {
+    case 126:
+        var ext [2]byte
+        if _, err = io.ReadFull(r, ext[:]); err != nil {
+            return
+        }
+        n = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err = io.ReadFull(r, ext[:]); err != nil {
+            return
+        }
+        n = binary.BigEndian.Uint64(ext[:])
+    }
+    switch {
+    case !masked, hdr[0]&0x70 != 0, op >= wsOpClose && (!fin || n > 125):
+        // Client frames must be masked, carry no extension bits, and
+        // control frames must be small and unfragmented.
+        err = wsError{wsCloseProtocolError}
+        return
+    case n > maxWebSocketPayload:
+        err = wsError{wsCloseTooBig}
+        return
+    }
+    var mask [4]byte
+    if _, err = io.ReadFull(r, mask[:]); err != nil {
+        return
+    }
+    payload = make([]byte, n)
+    if _, err = io.ReadFull(r, payload); err != nil {
+        return
+    }
+    for i := range payload {
+        payload[i] ^= mask[i%4]
+    }
+    return
+}
+
+// writeWebSocketFrame writes an unmasked server frame.
+func writeWebSocketFrame(w *bufio.Writer, fin bool, op byte, payload []byte) {
+    b0 := op
+    if fin {
+        b0 |= 0x80
+    }
+    w.WriteByte(b0)
+    switch n := len(payload); {
+    case n <= 125:
+        w.WriteByte(byte(n))
+    case n <= 0xffff:
+        w.WriteByte(126)
+        binary.Write(w, binary.BigEndian, uint16(n))
+    default:
+        w.WriteByte(127)
+        binary.Write(w, binary.BigEndian, uint64(n))
+    }
+    w.Write(payload)
+}
+
+func writeWebSocketClose(w *bufio.Writer, code uint16) {
+    writeWebSocketFrame(w, true, wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// handleBigHeaders adds ?count= custom headers (default 100) of ?size= bytes
+// each (default 4096) to the default response. They are named X-Big-<i>, or
+// all share the name given by ?name= to produce one many-valued header.
+func (s *server) handleBigHeaders(w http.ResponseWriter, r *http.Request) {
+    count, ok := queryInt(w, r, "count", 100)
+    if !ok {
+        return
+    }
+    size, ok := queryInt(w, r, "size", 4096)
+    if !ok {
+        return
+    }
+    name := r.URL.Query().Get("name")
+    value := string(fillBody(size))
+    for i := range count {
+        if name != "" {
+            w.Header().Add(name, value)
+            continue
+        }
+        w.Header().Set("X-Big-"+strconv.Itoa(i), value)
+    }
+    s.writeBody(w, s.body)
+}
+
+// handleTrailers sends the default body followed by X-Body-Bytes and
+// X-Body-Crc32 trailers. The body is sent without a Content-Length so that
+// HTTP/1.1 uses chunked encoding, which is required to carry trailers.
+func (s *server) handleTrailers(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Trailer", "X-Body-Bytes, X-Body-Crc32")
+    w.WriteHeader(http.StatusOK)
+    w.Write(s.body)
+    w.Header().Set("X-Body-Bytes", strconv.Itoa(len(s.body)))
+    w.Header().Set("X-Body-Crc32", fmt.Sprintf("%08x", crc32.ChecksumIEEE(s.body)))
+}
+
+// handleTrickle writes ?bytes= bytes of the body pattern (default 1000),
+// ?chunk= bytes at a time (default 1), flushing and then pausing ?interval=
+// (default 100ms) between writes. The status line is held back for ?ttfb=
+// (default 0), so a response-header timeout and a read-idle timeout can be
+// exercised separately: a long ?ttfb= with a short ?interval= should trip
+// only the former. It stops as soon as the client goes away.
+func (s *server) handleTrickle(w http.ResponseWriter, r *http.Request) {
+    size, ok := queryInt(w, r, "bytes", 1000)
+    if !ok {
+        return
+    }
+    chunk, ok := queryInt(w, r, "chunk", 1)
+    if !ok {
+        return
+    }
+    interval, ok := queryDuration(w, r, "interval", 100*time.Millisecond)
+    if !ok {
+        return
+    }
+    ttfb, ok := queryDuration(w, r, "ttfb", 0)
+    if !ok {
+        return
+    }
+    chunk = max(chunk, 1)
+    if !sleepCtx(r.Context(), ttfb) {
+        return
+    }
+    w.Header().Set("Content-Length", strconv.Itoa(size))
+    w.WriteHeader(http.StatusOK)
+    for off := 0; off < size; {
+        if off > 0 && !sleepCtx(r.Context(), interval) {
+            return
+        }
+        start := off % len(bodyPattern)
+        n := min(chunk, size-off, len(s.patternBuf)-start)
+        if _, err := w.Write(s.patternBuf[start : start+n]); err != nil {
+            return
+        }
+        flush(w)
+        off += n
+    }
+}
+
+// queryInt parses a non-negative integer query parameter, responding with
+// 400 if it is invalid.
+func queryInt(w http.ResponseWriter, r *http.Request, name string, def int) (int, bool) {
+    v := r.URL.Query().Get(name)
+    if v == "" {
+        return def, true
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 0 {
+        http.Error(w, "invalid "+name, http.StatusBadRequest)
+        return 0, false
+    }
+    return n, true
+}
+
+// queryDuration parses a non-negative duration query parameter, responding
+// with 400 if it is invalid.
+func queryDuration(w http.ResponseWriter, r *http.Request, name string, def time.Duration) (time.Duration, bool) {
+    v := r.URL.Query().Get(name)
+    if v == "" {
+        return def, true
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil || d < 0 {
+        http.Error(w, "invalid "+name, http.StatusBadRequest)
+        return 0, false
+    }
+    return d, true
+}
+
+// pathSize parses the {size} path value, responding with 400 if invalid.
+func pathSize(w http.ResponseWriter, r *http.Request) (int, bool) {
+    size, err := strconv.Atoi(r.PathValue("size"))
+    if err != nil || size < 0 {
+        http.Error(w, "invalid size", http.StatusBadRequest)
+        return 0, false
+    }
+    return size, true
+}
+
+// handleStatus responds with the status code given in the path.
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+    code, err := strconv.Atoi(r.PathValue("code"))
+    if err != nil || code < 200 || code > 599 {
+        http.Error(w, "invalid status code", http.StatusBadRequest)
+        return
+    }
+    http.Error(w, http.StatusText(code), code)
+}
+
+// handleFlaky fails with 503 for the fraction of requests given by ?rate=
+// (default 0.5) and otherwise serves the default body.
+func (s *server) handleFlaky(w http.ResponseWriter, r *http.Request) {
+    rate := 0.5
+    if v := r.URL.Query().Get("rate"); v != "" {
+        var err error
+        if rate, err = strconv.ParseFloat(v, 64); err != nil || rate < 0 || rate > 1 {
+            http.Error(w, "invalid rate", http.StatusBadRequest)
+            return
+        }
+    }
+    if rand.Float64() < rate {
+        http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+        return
+    }
+    s.writeBody(w, s.body)
+}
+
+// handleTruncate declares a Content-Length twice the size of the body it
+// sends and then aborts the connection, so clients see an unexpected EOF.
+func (s *server) handleTruncate(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Length", strconv.Itoa(2*len(s.body)))
+    w.WriteHeader(http.StatusOK)
+    w.Write(s.body)
+    flush(w)
+    panic(http.ErrAbortHandler)
+}
+
+// handleClose serves the default body and closes the connection afterwards,
+// regardless of -keepalive. It is also served as /goaway: on HTTP/2,
+// net/http turns Connection: close into a GOAWAY for this connection only,
+// letting in-flight streams finish while the client moves new requests to a
+// fresh connection.
+func (s *server) handleClose(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Connection", "close")
+    s.writeBody(w, s.body)
+}
+
+// malformation is a broken raw HTTP/1.1 response written by -fuzz-responses.
+type malformation struct {
+    name string
+    raw  string
+}
+
+// malformations lists every response -fuzz-responses can send; each one
+// can also be requested directly with ?fuzz=<name>.
+var malformations = []malformation{
+    {"bad-status", "HTTP/1.1 2OO OK\r\nContent-Length: 13\r\n\r\nHello, World!"},
+    {"bad-version", "HTTP/9.z 200 OK\r\nContent-Length: 13\r\n\r\nHello, World!"},
+    {"bad-chunk", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nHello, World!\r\n0\r\n\r\n"},
+    {"dup-length", "HTTP/1.1 200 OK\r\nContent-Length: 13\r\nContent-Length: 14\r\n\r\nHello, World!"},
+    {"no-crlf", "HTTP/1.1 200 OK\r\nContent-Length: 13\r\nX-Fuzz: no-crlf"},
+    {"bad-header", "HTTP/1.1 200 OK\r\nX Fuzz\r\nContent-Length: 13\r\n\r\nHello, World!"},
+    {"short-body", "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\nHello, World!"},
+}
+
+// parseMalformations returns the malformations named in the comma-separated
+// spec, or all of them if spec is empty.
+func parseMalformations(spec string) ([]malformation, error) {
+    if spec == "" {
+        return malformations, nil
+    }
+    var picked []malformation
+    for name := range strings.SplitSeq(spec, ",") {
+        m, ok := findMalformation(strings.TrimSpace(name))
+        if !ok {
+            return nil, fmt.Errorf("unknown -fuzz-kinds entry %q (want %s)", name, malformationNames())
+        }
+        picked = append(picked, m)
+    }
+    return picked, nil
+}
+
+func findMalformation(name string) (malformation, bool) {
+    for _, m := range malformations {
+        if m.name == name {
+            return m, true
+        }
+    }
+    return malformation{}, false
+}
+
+func malformationNames() string {
+    names := make([]string, len(malformations))
+    for i, m := range malformations {
+        names[i] = m.name
+    }
+    return strings.Join(names, ", ")
+}
+
+// fuzzed replaces the response, for the -fuzz-responses fraction of
+// requests or whenever ?fuzz= names a malformation, with a malformed one
+// written straight to the hijacked connection, which is then closed. HTTP/2
+// connections cannot be hijacked and are served normally.
+func (s *server) fuzzed(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var m malformation
+        if name := r.URL.Query().Get("fuzz"); name != "" {
+            var ok bool
+            if m, ok = findMalformation(name); !ok {
+                http.Error(w, "unknown fuzz "+strconv.Quote(name)+" (want "+malformationNames()+")", http.StatusBadRequest)
+                return
+            }
+        } else if s.cfg.fuzzRate > 0 && rand.Float64() < s.cfg.fuzzRate {
+            m = s.fuzz[rand.N(len(s.fuzz))]
+        }
+        if m.name == "" || r.ProtoMajor != 1 {
+            next.ServeHTTP(w, r)
+            return
+        }
+        conn, brw, err := http.NewResponseController(w).Hijack()
+        if err != nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        defer conn.Close()
+        brw.WriteString(m.raw)
+        brw.Flush()
+    })
+}
+
+// handleReset aborts the connection with a TCP RST before any response
+// bytes are written, so clients see a reset rather than a clean EOF.
+func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
+    resetConnection(w)
+}
+
+// handleResetMid declares a Content-Length of ?size= bytes (default: the
+// default body size), writes the first half of the body and then resets the
+// connection. Other sizes are written from patternBuf, so ?size= costs no
+// allocation.
+func (s *server) handleResetMid(w http.ResponseWriter, r *http.Request) {
+    size, ok := queryInt(w, r, "size", len(s.body))
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Length", strconv.Itoa(size))
+    w.WriteHeader(http.StatusOK)
+    if size == len(s.body) {
+        w.Write(s.body[:size/2])
+    } else {
+        for off := 0; off < size/2; {
+            p := s.pattern(off, size/2-off)
+            if _, err := w.Write(p); err != nil {
+                return
+            }
+            off += len(p)
+        }
+    }
+    flush(w)
+    resetConnection(w)
+}
+
+// handleStreamClose writes ?size= bytes of the body pattern (default 1000)
+// with neither Content-Length nor chunked encoding, then closes the
+// connection, so the body is delimited only by EOF. net/http always frames
+// HTTP/1.1 responses, so the response is written to the hijacked
+// connection; HTTP/2 has no close-delimited bodies and gets 505. A body
+// larger than maxHeaderDigest has no X-Body-Sha256, as there is nowhere to
+// put a trailer.
+func (s *server) handleStreamClose(w http.ResponseWriter, r *http.Request) {
+    size, ok := queryInt(w, r, "size", 1000)
+    if !ok {
+        return
+    }
+    if r.ProtoMajor != 1 {
+        http.Error(w, "close-delimited bodies need HTTP/1.x", http.StatusHTTPVersionNotSupported)
+        return
+    }
+    h := w.Header().Clone()
+    if sum, ok := s.bodySum(size); ok {
+        h.Set("X-Body-Sha256", hex.EncodeToString(sum[:]))
+    }
+    h.Set("Content-Type", "application/octet-stream")
+    h.Set("Connection", "close")
+    h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+    conn, brw, err := http.NewResponseController(w).Hijack()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer conn.Close()
+    fmt.Fprintf(brw, "HTTP/1.%d 200 OK\r\n", r.ProtoMinor)
+    h.Write(brw)
+    brw.WriteString("\r\n")
+    for off := 0; off < size; {
+        start := off % len(bodyPattern)
+        n := min(size-off, len(s.patternBuf)-start)
+        if _, err := brw.Write(s.patternBuf[start : start+n]); err != nil {
+            return
+        }
+        off += n
+    }
+    brw.Flush()
+}
+
+// resetConnection hijacks the connection and closes it with SO_LINGER set to
+// zero, which makes the kernel send an RST instead of a FIN. HTTP/2 cannot be
+// hijacked, so there the stream is aborted with RST_STREAM instead.
+func resetConnection(w http.ResponseWriter) {
+    conn, _, err := http.NewResponseController(w).Hijack()
+    if err != nil {
+        panic(http.ErrAbortHandler)
+    }
+    for c := conn; c != nil; {
+        switch t := c.(type) {
+        case *net.TCPConn:
+            t.SetLinger(0)
+            c = nil
+        case interface{ NetConn() net.Conn }:
+            c = t.NetConn()
+        default:
+            c = nil
+        }
+    }
+    conn.Close()
+}
+
+// copyBufPool holds the fixed-size buffers used to stream request bodies, so
+// uploads never buffer fully in memory.
+var copyBufPool = sync.Pool{New: func() any { return new([32 << 10]byte) }}
+
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+    buf := copyBufPool.Get().(*[32 << 10]byte)
+    defer copyBufPool.Put(buf)
+    return io.CopyBuffer(dst, src, buf[:])
+}
+
+// limitUpload enforces -max-upload on the request body. It responds with 413
+// and returns false when the declared Content-Length is already too large.
+func (s *server) limitUpload(w http.ResponseWriter, r *http.Request) bool {
+    if s.cfg.maxUpload <= 0 {
+        return true
+    }
+    if r.ContentLength > s.cfg.maxUpload {
+        http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+        return false
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxUpload)
+    return true
+}
+
+// handleUpload drains the request body and reports its size. A body with
+// Content-Encoding gzip, deflate, br or zstd is decompressed first, and both
+// sizes are reported; -max-upload applies to the compressed size. Any other
+// encoding is refused with 415 and an Accept-Encoding listing what is
+// supported.
+func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
+    if !s.limitUpload(w, r) {
+        return
+    }
+    var wire atomic.Uint64
+    body, closeBody, err := decodeContentEncoding(countingReader{ReadCloser: r.Body, n: &wire}, r.Header.Values("Content-Encoding"))
+    if err != nil {
+        uploadError(w, err)
+        return
+    }
+    defer closeBody()
+    n, err := copyBody(io.Discard, body)
+    if err != nil {
+        uploadError(w, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]int64{"bytes": n, "compressed_bytes": int64(wire.Load())})
+}
+
+// uploadError responds to a failure reading an upload body.
+func uploadError(w http.ResponseWriter, err error) {
+    var tooLarge *http.MaxBytesError
+    var unsupported unsupportedEncodingError
+    switch {
+    case errors.As(err, &tooLarge):
+        http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+    case errors.As(err, &unsupported):
+        w.Header().Set("Accept-Encoding", "gzip, deflate, br, zstd")
+        http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+    default:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    }
+}
+
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+    return "unsupported Content-Encoding " + strconv.Quote(string(e))
+}
+
+// decodeContentEncoding undoes the codings listed in Content-Encoding,
+// innermost (last listed) first. The returned func releases the decoders.
+func decodeContentEncoding(body io.Reader, values []string) (io.Reader, func(), error) {
+    var codings []string
+    for _, v := range values {
+        for c := range strings.SplitSeq(v, ",") {
+            if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+                codings = append(codings, c)
+            }
+        }
+    }
+    for _, c := range codings {
+        switch c {
+        case "gzip", "x-gzip", "deflate", "br", "zstd":
+        default:
+            return nil, nil, unsupportedEncodingError(c)
+        }
+    }
+    var closers []func()
+    closeAll := func() {
+        for _, c := range closers {
+            c()
+        }
+    }
+    for i := len(codings) - 1; i >= 0; i-- {
+        var err error
+        switch codings[i] {
+        case "gzip", "x-gzip":
+            body, err = gzip.NewReader(body)
+        case "deflate":
+            body, err = zlib.NewReader(body)
+        case "br":
+            body = brotli.NewReader(body)
+        case "zstd":
+            var d *zstd.Decoder
+            if d, err = zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)); err == nil {
+                closers = append(closers, d.Close)
+                body = d
+            }
+        }
+        if err != nil {
+            closeAll()
+            return nil, nil, err
+        }
+    }
+    return body, closeAll, nil
+}
+
+// handleEchoBody streams the request body back as the response body. If
+// -max-upload is exceeded after the response has started, the connection is
+// aborted since the status can no longer change.
+func (s *server) handleEchoBody(w http.ResponseWriter, r *http.Request) {
+    if !s.limitUpload(w, r) {
+        return
+    }
+    http.NewResponseController(w).EnableFullDuplex()
+    if ct := r.Header.Get("Content-Type"); ct != "" {
+        w.Header().Set("Content-Type", ct)
+    }
+    if r.ContentLength >= 0 {
+        w.Header().Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+    }
+    // The status line is sent on the first write, after the first read, so
+    // an Expect: 100-continue request still gets its 100 Continue.
+    if _, err := copyBody(w, r.Body); err != nil {
+        panic(http.ErrAbortHandler)
+    }
+}
+
+// handleWhoami reports the subject CN of the client certificate verified
+// during the TLS handshake.
+func (s *server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+        http.Error(w, "no verified client certificate", http.StatusUnauthorized)
+        return
+    }
+    leaf := r.TLS.VerifiedChains[0][0]
+    writeJSON(w, http.StatusOK, map[string]string{"cn": leaf.Subject.CommonName})
+}
+
+// handleRedirect answers with ?n= (default 5) chained 302 redirects back to
+// itself before serving the default body. ?absolute=1 makes each Location an
+// absolute URL instead of a path, and ?loop=1 redirects to the same URL
+// forever so clients have to enforce their own redirect limit.
+func (s *server) handleRedirect(w http.ResponseWriter, r *http.Request) {
+    n, ok := queryInt(w, r, "n", 5)
+    if !ok {
+        return
+    }
+    q := r.URL.Query()
+    if q.Get("loop") != "1" {
+        if n == 0 {
+            s.writeBody(w, s.body)
+            return
+        }
+        q.Set("n", strconv.Itoa(n-1))
+    }
+    loc := &url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+    if q.Get("absolute") == "1" {
+        loc.Scheme, loc.Host = "http", r.Host
+        if r.TLS != nil {
+            loc.Scheme = "https"
+        }
+    }
+    w.Header().Set("Location", loc.String())
+    w.WriteHeader(http.StatusFound)
+}
+
+// handleSetCookie sets the cookie ?name= (default "session") to ?value=
+// (default "1") and redirects to ?next= (default /cookies), so clients can
+// check that their cookie jar carries it across the redirect.
+func (s *server) handleSetCookie(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    c := &http.Cookie{Name: q.Get("name"), Value: q.Get("value"), Path: "/"}
+    if c.Name == "" {
+        c.Name = "session"
+    }
+    if c.Value == "" {
+        c.Value = "1"
+    }
+    if err := c.Valid(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    next := q.Get("next")
+    if next == "" {
+        next = "/cookies"
+    }
+    http.SetCookie(w, c)
+    w.Header().Set("Location", next)
+    w.WriteHeader(http.StatusFound)
+}
+
+// handleCookies reports the cookies sent with the request.
+func (s *server) handleCookies(w http.ResponseWriter, r *http.Request) {
+    cookies := map[string]string{}
+    for _, c := range r.Cookies() {
+        cookies[c.Name] = c.Value
+    }
+    writeJSON(w, http.StatusOK, map[string]map[string]string{"cookies": cookies})
+}
+
+// handleTLSInfo reports the TLS parameters negotiated on the connection,
+// including whether the handshake resumed an earlier session.
+func (s *server) handleTLSInfo(w http.ResponseWriter, r *http.Request) {
+    if r.TLS == nil {
+        http.Error(w, "not a TLS connection", http.StatusBadRequest)
+        return
+    }
+    writeJSON(w, http.StatusOK, struct {
+        DidResume   bool   `json:"did_resume"`
+        Version     string `json:"version"`
+        CipherSuite string `json:"cipher_suite"`
+        ALPN        string `json:"alpn"`
+        ServerName  string `json:"server_name"`
+    }{
+        DidResume:   r.TLS.DidResume,
+        Version:     tls.VersionName(r.TLS.Version),
+        CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+        ALPN:        r.TLS.NegotiatedProtocol,
+        ServerName:  r.TLS.ServerName,
+    })
+}
+
+// writeBody writes a pre-built body, either with a Content-Length or in
+// chunkSize writes when chunked mode is enabled.
+func (s *server) writeBody(w http.ResponseWriter, body []byte) {
+    if !s.cfg.chunked {
+        w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+        w.WriteHeader(http.StatusOK)
+        w.Write(body)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+    for len(body) > 0 {
+        n := min(s.cfg.chunkSize, len(body))
+        if _, err := w.Write(body[:n]); err != nil {
+            return
+        }
+        flush(w)
+        body = body[n:]
+    }
+}
+
+// writeStream writes a size-byte body produced incrementally by next, which
+// returns the next piece of at most n bytes starting at body offset off.
+// Content-Length is left out when trailers are declared, since HTTP/1.1 can
+// only carry them after a chunked body.
+func (s *server) writeStream(w http.ResponseWriter, size int, next func(off, n int) []byte) {
+    step := len(s.patternBuf)
+    if s.cfg.chunked {
+        step = s.cfg.chunkSize
+    } else if w.Header().Get("Trailer") == "" {
+        w.Header().Set("Content-Length", strconv.Itoa(size))
+    }
+    w.WriteHeader(http.StatusOK)
+    for off := 0; off < size; {
+        p := next(off, min(step, size-off))
+        if _, err := w.Write(p); err != nil {
+            return
+        }
+        if s.cfg.chunked {
+            flush(w)
+        }
+        off += len(p)
+    }
+}
+
+// connInfo is attached to every connection's context by connContext.
+type connInfo struct {
+    loggedProto atomic.Bool
+    served      atomic.Bool
+    primed      atomic.Bool
+    vhostOnce   sync.Once
+    vhost       string
+    localPort   string
+
+    // bucket is the connection's -rate limiter, created on first use.
+    bucketOnce sync.Once
+    bucket     *tokenBucket
+}
+
+type connInfoKey struct{}
+
+func connContext(ctx context.Context, c net.Conn) context.Context {
+    ci := &connInfo{}
+    if _, port, err := net.SplitHostPort(c.LocalAddr().String()); err == nil {
+        ci.localPort = port
+    }
+    return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+// tagListenerPort sets X-Listener-Port to the local port the request's
+// connection was accepted on.
+func tagListenerPort(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && ci.localPort != "" {
+            w.Header().Set("X-Listener-Port", ci.localPort)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// tokenBucket limits throughput to rate bytes per second, allowing bursts of
+// up to burst bytes.
+type tokenBucket struct {
+    rate  float64
+    burst int
+
+    mu     sync.Mutex
+    tokens float64
+    last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+    // Allow about 50ms worth of data per write.
+    burst := int(min(max(rate/20, 1), 64<<10))
+    return &tokenBucket{rate: float64(rate), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes n tokens, going into debt if necessary, and returns how long
+// the caller must wait before sending n bytes.
+func (b *tokenBucket) reserve(n int) time.Duration {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    now := time.Now()
+    b.tokens = min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+    b.last = now
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledWriter paces body writes through a token bucket, flushing each
+// burst so the pacing is visible on the wire.
+type throttledWriter struct {
+    http.ResponseWriter
+    ctx    context.Context
+    bucket *tokenBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := min(len(p), tw.bucket.burst)
+        if !sleepCtx(tw.ctx, tw.bucket.reserve(n)) {
+            return written, tw.ctx.Err()
+        }
+        m, err := tw.ResponseWriter.Write(p[:n])
+        written += m
+        if err != nil {
+            return written, err
+        }
+        flush(tw.ResponseWriter)
+        p = p[n:]
+    }
+    return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+    flush(tw.ResponseWriter)
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+    return tw.ResponseWriter
+}
+
+// throttle limits response bodies to -rate bytes per second per connection,
+// shared by all requests on it. A ?rate= query parameter gives the request
+// its own limit instead, except on /flaky where rate is the failure fraction.
+// Writes stop as soon as the request context is cancelled.
+func (s *server) throttle(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var bucket *tokenBucket
+        if v := r.URL.Query().Get("rate"); v != "" && r.URL.Path != "/flaky" {
+            rate, err := strconv.ParseInt(v, 10, 64)
+            if err != nil || rate <= 0 {
+                http.Error(w, "invalid rate", http.StatusBadRequest)
+                return
+            }
+            bucket = newTokenBucket(rate)
+        } else if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && s.cfg.rate > 0 {
+            ci.bucketOnce.Do(func() { ci.bucket = newTokenBucket(s.cfg.rate) })
+            bucket = ci.bucket
+        }
+        if bucket == nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        next.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), bucket: bucket}, r)
+    })
+}
+
+// connStateLogger logs every connection state transition along with the
+// number of connections currently open.
+func connStateLogger() func(net.Conn, http.ConnState) {
+    var open atomic.Int64
+    return func(c net.Conn, state http.ConnState) {
+        n := open.Load()
+        switch state {
+        case http.StateNew:
+            n = open.Add(1)
+        case http.StateClosed, http.StateHijacked:
+            n = open.Add(-1)
+        }
+        log.Printf("conn %s: %s (open=%d)", peerAddr(c), state, n)
+    }
+}
+
+// peerAddr is c.RemoteAddr without waiting for a PROXY header. ConnState
+// runs StateNew on the accept goroutine, where waiting for the header would
+// let one slow client hold up every other connection.
+func peerAddr(c net.Conn) net.Addr {
+    if pc, ok := c.(*proxyConn); ok && !pc.parsed.Load() {
+        return pc.Conn.RemoteAddr()
+    }
+    return c.RemoteAddr()
+}
+
+// logProtocol logs the protocol negotiated on each connection the first time
+// a request arrives on it.
+func logProtocol(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && ci.loggedProto.CompareAndSwap(false, true) {
+            log.Printf("conn %s: %s", r.RemoteAddr, r.Proto)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// parseHeaderList parses a comma-separated list of Name:Value pairs.
+// Repeating a name adds another value rather than replacing the first.
+func parseHeaderList(spec string) (http.Header, error) {
+    h := make(http.Header)
+    if spec == "" {
+        return h, nil
+    }
+    for pair := range strings.SplitSeq(spec, ",") {
+        name, value, ok := strings.Cut(pair, ":")
+        name = strings.TrimSpace(name)
+        if !ok || name == "" {
+            return nil, fmt.Errorf("invalid -extra-headers entry %q (want Name:Value)", pair)
+        }
+        h.Add(name, strings.TrimSpace(value))
+    }
+    return h, nil
+}
+
+// parseVhosts parses a comma-separated list of host=body pairs.
+func parseVhosts(spec string) (map[string][]byte, error) {
+    vhosts := make(map[string][]byte)
+    if spec == "" {
+        return vhosts, nil
+    }
+    for pair := range strings.SplitSeq(spec, ",") {
+        host, body, ok := strings.Cut(pair, "=")
+        host = strings.ToLower(strings.TrimSpace(host))
+        if !ok || host == "" {
+            return nil, fmt.Errorf("invalid -vhosts entry %q (want host=body)", pair)
+        }
+        vhosts[host] = []byte(body)
+    }
+    return vhosts, nil
+}
+
+type vhostBodyKey struct{}
+
+// virtualHosts routes requests by Host. A request for one of the -vhosts
+// gets X-Vhost, and the host's body is passed in the request context for
+// the / handler to serve in place of the default one; other paths and
+// unknown hosts are served by the normal routes. It runs inside each route's
+// middleware chain, so vhost requests are delayed, limited and counted like
+// any other.
+//
+// An HTTP/2 connection is bound to the host of its first request. A later
+// request on it for a different vhost is refused with 421 Misdirected
+// Request, as a server whose certificate did not cover both names would, so
+// clients that coalesce connections must retry on a fresh one.
+func (s *server) virtualHosts(next http.Handler) http.Handler {
+    if len(s.vhosts) == 0 {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        host = strings.ToLower(host)
+        body, ok := s.vhosts[host]
+        if ci, _ := r.Context().Value(connInfoKey{}).(*connInfo); ci != nil && r.ProtoMajor == 2 {
+            ci.vhostOnce.Do(func() { ci.vhost = host })
+            if ok && ci.vhost != host {
+                http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+                return
+            }
+        }
+        if !ok {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Set("X-Vhost", host)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), vhostBodyKey{}, body)))
+    })
+}
+
+// addHeaders adds every value in extra to each response.
+func addHeaders(extra http.Header, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        h := w.Header()
+        for name, values := range extra {
+            h[name] = append(h[name], values...)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// requestSeq numbers the request IDs generated by requestIDs.
+var requestSeq atomic.Uint64
+
+// requestIDs echoes the request's X-Request-ID in the response, generating
+// one first if the client sent none. The request headers are left as the
+// client sent them; the access log reads the ID from the response. Generated
+// IDs are a per-process counter plus a random suffix, so they stay unique
+// across concurrent requests and restarts.
+func requestIDs(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if id == "" {
+            id = fmt.Sprintf("%d-%08x", requestSeq.Add(1), rand.Uint32())
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// http10Responses makes net/http answer HTTP/1.x requests as an HTTP/1.0
+// server would: an HTTP/1.0 status line, no chunked encoding (a body without
+// Content-Length is delimited by closing the connection) and a close after
+// every response. net/http decides all of this from the request's protocol
+// version, so it is downgraded in place before anything is written.
+//
+// Keep-alive is only kept where HTTP/1.0 negotiates it, on an HTTP/1.0
+// request with Connection: keep-alive and a response with Content-Length.
+// net/http settles that when it reads the request, so an HTTP/1.1 request
+// asking for keep-alive is still closed after its response.
+//
+// HTTP/1.0 has no 1xx responses, but net/http answers the first body read of
+// an HTTP/1.1 Expect: 100-continue request with a 100 Continue, so such
+// requests get 417 instead and the client can resend without the Expect.
+//
+// It must be the outermost middleware: a handler that clones the request
+// before it would downgrade only the copy.
+func http10Responses(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.ProtoMajor == 1 {
+            expect := r.ProtoMinor > 0 && r.ContentLength != 0 &&
+                strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+            r.Proto, r.ProtoMinor = "HTTP/1.0", 0
+            if expect {
+                http.Error(w, "HTTP/1.0 has no 100 Continue", http.StatusExpectationFailed)
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// closeConnections marks every response with Connection: close.
+func closeConnections(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Connection", "close")
+        next.ServeHTTP(w, r)
+    })
+}
+
+var (
+    gzipPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+    zlibPool = sync.Pool{New: func() any { return zlib.NewWriter(nil) }}
 )
 
-func handler(w http.ResponseWriter, r *http.Request) {
-    w.WriteHeader(http.StatusOK)
-    w.Write([]byte("Hello, World!"))
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring the higher q-value and gzip on ties. It returns "" when the
+// client accepts neither, meaning identity.
+func negotiateEncoding(accept string) string {
+    best, bestQ := "", 0.0
+    for part := range strings.SplitSeq(accept, ",") {
+        name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        name = strings.ToLower(strings.TrimSpace(name))
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            var err error
+            if q, err = strconv.ParseFloat(v, 64); err != nil {
+                continue
+            }
+        }
+        if (name == "gzip" || name == "deflate") && (q > bestQ || q == bestQ && name == "gzip") {
+            best, bestQ = name, q
+        }
+    }
+    return best
+}
+
+// compressResponses compresses response bodies with the encoding negotiated
+// from the request's Accept-Encoding header.
+func compressResponses(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Vary", "Accept-Encoding")
+        encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+        if encoding == "" || r.Method == http.MethodHead {
+            next.ServeHTTP(w, r)
+            return
+        }
+        // The handler validates against identity tags, so strip the
+        // encoding suffix that encodedETag added to the client's copy.
+        if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Match") != "" {
+            r = r.Clone(r.Context())
+            for _, name := range []string{"If-None-Match", "If-Match"} {
+                if v := r.Header.Get(name); v != "" {
+                    r.Header.Set(name, strings.ReplaceAll(v, "-"+encoding+`"`, `"`))
+                }
+            }
+        }
+        cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+        defer cw.close()
+        next.ServeHTTP(cw, r)
+    })
+}
+
+// compressWriter compresses the body once the first bytes are written,
+// unless the response has no body, the handler already set a
+// Content-Encoding, or it is a range response, whose Content-Range counts
+// identity bytes. The status line is held back until then so the content
+// type can be sniffed from the uncompressed bytes; the server does not sniff
+// once Content-Encoding is set.
+type compressWriter struct {
+    http.ResponseWriter
+    encoding string
+    status   int
+    started  bool
+    gz       *gzip.Writer
+    zw       *zlib.Writer
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+    if code < 200 {
+        cw.ResponseWriter.WriteHeader(code)
+        return
+    }
+    if cw.status == 0 {
+        cw.status = code
+    }
+}
+
+// start sends the held status, switching to compression if the response
+// can carry a body. p is the first chunk of the body, if any.
+func (cw *compressWriter) start(p []byte) {
+    if cw.started {
+        return
+    }
+    cw.started = true
+    if cw.status == 0 {
+        cw.status = http.StatusOK
+    }
+    h := cw.Header()
+    if cw.status != http.StatusNoContent && cw.status != http.StatusNotModified && cw.status != http.StatusPartialContent &&
+        h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+        if h.Get("Content-Type") == "" && len(p) > 0 {
+            h.Set("Content-Type", http.DetectContentType(p))
+        }
+        h.Del("Content-Length")
+        h.Set("Content-Encoding", cw.encoding)
+        cw.tagETag()
+        if cw.encoding == "gzip" {
+            cw.gz = gzipPool.Get().(*gzip.Writer)
+            cw.gz.Reset(cw.ResponseWriter)
+        } else {
+            cw.zw = zlibPool.Get().(*zlib.Writer)
+            cw.zw.Reset(cw.ResponseWriter)
+        }
+    }
+    cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// tagETag gives the compressed representation its own entity tag, since
+// strong validators must differ between content-codings.
+func (cw *compressWriter) tagETag() {
+    h := cw.Header()
+    if tag := h.Get("ETag"); len(tag) >= 2 && strings.HasSuffix(tag, `"`) {
+        h.Set("ETag", tag[:len(tag)-1]+"-"+cw.encoding+`"`)
+    }
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+    cw.start(p)
+    switch {
+    case cw.gz != nil:
+        return cw.gz.Write(p)
+    case cw.zw != nil:
+        return cw.zw.Write(p)
+    }
+    return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) Flush() {
+    cw.start(nil)
+    switch {
+    case cw.gz != nil:
+        cw.gz.Flush()
+    case cw.zw != nil:
+        cw.zw.Flush()
+    }
+    flush(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+    return cw.ResponseWriter
+}
+
+// close finishes the compressed stream. A response with no body is sent
+// uncompressed.
+func (cw *compressWriter) close() {
+    if !cw.started {
+        if cw.status == http.StatusNotModified && cw.Header().Get("Content-Encoding") == "" {
+            // The client's cached copy is the compressed one.
+            cw.tagETag()
+        }
+        if cw.status != 0 {
+            cw.ResponseWriter.WriteHeader(cw.status)
+        }
+        return
+    }
+    switch {
+    case cw.gz != nil:
+        cw.gz.Close()
+        gzipPool.Put(cw.gz)
+    case cw.zw != nil:
+        cw.zw.Close()
+        zlibPool.Put(cw.zw)
+    }
+}
+
+// clientAuthConfig returns a TLS config that requires client certificates
+// signed by a CA in caFile. Handshakes without a trusted certificate fail
+// with a TLS alert.
+func clientAuthConfig(caFile string) (*tls.Config, error) {
+    pem, err := os.ReadFile(caFile)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("no certificates found in %s", caFile)
+    }
+    return &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}, nil
+}
+
+// maxCachedSessions bounds the -tls-resumption=cache session store.
+const maxCachedSessions = 10000
+
+// setResumption configures how TLS sessions are resumed: "tickets" issues
+// stateless tickets encrypting the session, "cache" keeps sessions in server
+// memory and hands out only an opaque ID, and "off" forces a full handshake
+// on every connection.
+func setResumption(tc *tls.Config, mode string) error {
+    switch mode {
+    case "tickets":
+    case "off":
+        tc.SessionTicketsDisabled = true
+    case "cache":
+        c := &sessionCache{sessions: make(map[string][]byte)}
+        tc.WrapSession = c.wrap
+        tc.UnwrapSession = c.unwrap
+    default:
+        return fmt.Errorf("unknown -tls-resumption %q (want tickets, cache or off)", mode)
+    }
+    return nil
+}
+
+// sessionCache is a server-side TLS session store. When full, an arbitrary
+// entry is evicted to make room.
+type sessionCache struct {
+    mu       sync.Mutex
+    sessions map[string][]byte
+}
+
+func (c *sessionCache) wrap(_ tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+    b, err := ss.Bytes()
+    if err != nil {
+        return nil, err
+    }
+    var id [16]byte
+    crand.Read(id[:])
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if len(c.sessions) >= maxCachedSessions {
+        for k := range c.sessions {
+            delete(c.sessions, k)
+            break
+        }
+    }
+    c.sessions[string(id[:])] = b
+    return id[:], nil
+}
+
+// unwrap returns the cached session for id, or nil (a full handshake) if it
+// is unknown or was evicted.
+func (c *sessionCache) unwrap(id []byte, _ tls.ConnectionState) (*tls.SessionState, error) {
+    c.mu.Lock()
+    b, ok := c.sessions[string(id)]
+    c.mu.Unlock()
+    if !ok {
+        return nil, nil
+    }
+    return tls.ParseSessionState(b)
+}
+
+// loadConfig applies the settings in a JSON config file. Keys are flag names
+// without the dash and values are strings, numbers or booleans written as
+// the flag would take them (durations as strings such as "1.5s"); a
+// string-typed flag only takes a string, and a repeatable flag such as addr
+// also accepts an array. Flags set on the command line are left alone. The
+// result is then checked with validateConfig, and every unknown key, invalid
+// value and failed check is reported together, not just the first.
+func loadConfig(fs *flag.FlagSet, path string, cfg *config) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var settings map[string]json.RawMessage
+    if err := json.Unmarshal(data, &settings); err != nil {
+        return fmt.Errorf("config %s: %v", path, err)
+    }
+    explicit := make(map[string]bool)
+    fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+    names := make([]string, 0, len(settings))
+    for name := range settings {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var invalid []string
+    for _, name := range names {
+        if name == "config" || fs.Lookup(name) == nil {
+            invalid = append(invalid, fmt.Sprintf("%s: unknown setting", name))
+            continue
+        }
+        if explicit[name] {
+            continue
+        }
+        values, err := configValues(settings[name], stringFlag(fs.Lookup(name)))
+        if err == nil {
+            for _, v := range values {
+                if serr := fs.Set(name, v); serr != nil {
+                    err = fmt.Errorf("invalid value %q: %v", v, serr)
+                    break
+                }
+            }
+        }
+        if err != nil {
+            invalid = append(invalid, fmt.Sprintf("%s: %v", name, err))
+        }
+    }
+    invalid = append(invalid, validateConfig(*cfg)...)
+    if len(invalid) > 0 {
+        return fmt.Errorf("config %s has invalid settings:\n  %s", path, strings.Join(invalid, "\n  "))
+    }
+    return nil
+}
+
+// stringFlag reports whether f takes free-form text rather than a number,
+// boolean or duration. Flags without a typed value, such as the repeatable
+// addr, count as strings.
+func stringFlag(f *flag.Flag) bool {
+    g, ok := f.Value.(flag.Getter)
+    if !ok {
+        return true
+    }
+    _, isString := g.Get().(string)
+    return isString
+}
+
+// configValues returns the flag value text for a config file value. If
+// onlyStrings is set, numbers and booleans are rejected.
+func configValues(raw json.RawMessage, onlyStrings bool) ([]string, error) {
+    var list []json.RawMessage
+    if len(raw) > 0 && raw[0] == '[' && json.Unmarshal(raw, &list) == nil {
+        var values []string
+        for _, item := range list {
+            v, err := configValue(item, onlyStrings)
+            if err != nil {
+                return nil, err
+            }
+            values = append(values, v)
+        }
+        return values, nil
+    }
+    v, err := configValue(raw, onlyStrings)
+    if err != nil {
+        return nil, err
+    }
+    return []string{v}, nil
+}
+
+func configValue(raw json.RawMessage, onlyStrings bool) (string, error) {
+    var v any
+    if err := json.Unmarshal(raw, &v); err != nil {
+        return "", err
+    }
+    switch v := v.(type) {
+    case string:
+        return v, nil
+    case float64, bool:
+        if onlyStrings {
+            return "", fmt.Errorf("want a string, got %s", raw)
+        }
+        return string(raw), nil
+    }
+    return "", fmt.Errorf("want a string, number or boolean, got %s", raw)
+}
+
+// validateConfig runs the startup checks on cfg and returns every problem
+// found. The list parsers are run here only for their errors; newServer
+// parses them again.
+func validateConfig(cfg config) []string {
+    var problems []string
+    check := func(err error) {
+        if err != nil {
+            problems = append(problems, err.Error())
+        }
+    }
+    _, err := protocols(cfg.proto)
+    check(err)
+    tlsMode := cfg.proto == "h2"
+    if tlsMode && (cfg.certFile == "" || cfg.keyFile == "") {
+        problems = append(problems, "-proto=h2 requires -cert and -key")
+    }
+    if cfg.clientCAFile != "" && !tlsMode {
+        problems = append(problems, "-client-ca requires -proto=h2")
+    }
+    check(setResumption(&tls.Config{}, cfg.tlsResumption))
+    if cfg.logFormat != "off" {
+        _, err = newAccessLogger(io.Discard, cfg.logFormat)
+        check(err)
+    }
+    if cfg.chunkSize <= 0 {
+        problems = append(problems, "-chunk-size must be positive")
+    }
+    for _, c := range []struct {
+        name string
+        v    int64
+    }{
+        {"backlog", int64(cfg.backlog)},
+        {"body-size", int64(cfg.bodySize)},
+        {"max-upload", cfg.maxUpload},
+        {"max-concurrent", int64(cfg.maxConcurrent)},
+        {"max-header-bytes", int64(cfg.maxHeaderBytes)},
+        {"retry-after", int64(cfg.retryAfter)},
+        {"rate", cfg.rate},
+        {"default-alloc", int64(cfg.defaultAlloc)},
+    } {
+        if c.v < 0 {
+            problems = append(problems, fmt.Sprintf("-%s must not be negative", c.name))
+        }
+    }
+    for _, c := range []struct {
+        name string
+        d    time.Duration
+    }{
+        {"shutdown-timeout", cfg.shutdownTimeout},
+        {"drain-delay", cfg.drainDelay},
+        {"warmup", cfg.warmup},
+        {"read-timeout", cfg.readTimeout},
+        {"read-header-timeout", cfg.readHeaderTimeout},
+        {"write-timeout", cfg.writeTimeout},
+        {"idle-timeout", cfg.idleTimeout},
+        {"queue-timeout", cfg.queueTimeout},
+        {"delay", cfg.delay},
+        {"jitter", cfg.jitter},
+        {"default-work", cfg.defaultWork},
+    } {
+        if c.d < 0 {
+            problems = append(problems, fmt.Sprintf("-%s must not be negative", c.name))
+        }
+    }
+    if cfg.defaultAlloc > maxAllocMB {
+        problems = append(problems, fmt.Sprintf("-default-alloc must be at most %d", maxAllocMB))
+    }
+    if cfg.fuzzRate < 0 || cfg.fuzzRate > 1 {
+        problems = append(problems, "-fuzz-responses must be between 0 and 1")
+    }
+    if cfg.genFiles && cfg.staticDir == "" {
+        problems = append(problems, "-gen-files requires -static-dir")
+    }
+    _, err = newSequence(cfg.sequence)
+    check(err)
+    _, err = parseHeaderList(cfg.extraHeaders)
+    check(err)
+    _, err = parseVhosts(cfg.vhosts)
+    check(err)
+    _, err = parseMalformations(cfg.fuzzKinds)
+    check(err)
+    return problems
+}
+
+// protocols returns the protocol set for the -proto mode.
+func protocols(mode string) (*http.Protocols, error) {
+    p := new(http.Protocols)
+    switch mode {
+    case "h1":
+        p.SetHTTP1(true)
+    case "h2c":
+        p.SetHTTP1(true)
+        p.SetUnencryptedHTTP2(true)
+    case "h2":
+        p.SetHTTP1(true)
+        p.SetHTTP2(true)
+    default:
+        return nil, fmt.Errorf("unknown -proto %q (want h1, h2c or h2)", mode)
+    }
+    return p, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func flush(w http.ResponseWriter) {
+    http.NewResponseController(w).Flush()
+}
+
+// responseRecorder captures the status and body size written by a handler.
+type responseRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+// WriteHeader records the final status; informational 1xx codes, such as
+// the 100 Continue /expect sends, are passed through but not recorded.
+func (rw *responseRecorder) WriteHeader(code int) {
+    if rw.status == 0 && code >= 200 {
+        rw.status = code
+    }
+    rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+    if rw.status == 0 {
+        rw.status = http.StatusOK
+    }
+    n, err := rw.ResponseWriter.Write(p)
+    rw.bytes += int64(n)
+    return n, err
+}
+
+func (rw *responseRecorder) Flush() {
+    flush(rw.ResponseWriter)
+}
+
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+    return rw.ResponseWriter
+}
+
+// accessLogger writes one line per request to a buffered writer that is
+// flushed periodically, so logging stays off the request's critical path.
+type accessLogger struct {
+    json bool
+
+    mu  sync.Mutex
+    out *bufio.Writer
+}
+
+type accessLogEntry struct {
+    Time       time.Time `json:"time"`
+    Method     string    `json:"method"`
+    Path       string    `json:"path"`
+    Status     int       `json:"status"`
+    Bytes      int64     `json:"bytes"`
+    RemoteAddr string    `json:"remote_addr"`
+    Proto      string    `json:"proto"`
+    DurationUs float64   `json:"duration_us"`
+    RequestID  string    `json:"request_id"`
+}
+
+func newAccessLogger(w io.Writer, format string) (*accessLogger, error) {
+    if format != "text" && format != "json" {
+        return nil, fmt.Errorf("unknown -log %q (want off, text or json)", format)
+    }
+    return &accessLogger{json: format == "json", out: bufio.NewWriterSize(w, 64<<10)}, nil
+}
+
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rw := &responseRecorder{ResponseWriter: w}
+        defer func() {
+            if rw.status == 0 {
+                rw.status = http.StatusOK
+            }
+            l.log(accessLogEntry{
+                Time:       start,
+                Method:     r.Method,
+                Path:       r.URL.Path,
+                Status:     rw.status,
+                Bytes:      rw.bytes,
+                RemoteAddr: r.RemoteAddr,
+                Proto:      r.Proto,
+                DurationUs: micros(int64(time.Since(start))),
+                RequestID:  rw.Header().Get("X-Request-ID"),
+            })
+        }()
+        next.ServeHTTP(rw, r)
+    })
+}
+
+func (l *accessLogger) log(e accessLogEntry) {
+    var line []byte
+    if l.json {
+        line, _ = json.Marshal(e)
+        line = append(line, '\n')
+    } else {
+        line = fmt.Appendf(nil, "%s %s %s %d %d %s %s %.1fus %s\n",
+            e.Time.Format(time.RFC3339Nano), e.Method, e.Path, e.Status, e.Bytes, e.RemoteAddr, e.Proto, e.DurationUs, e.RequestID)
+    }
+    l.mu.Lock()
+    l.out.Write(line)
+    l.mu.Unlock()
+}
+
+func (l *accessLogger) flush() {
+    l.mu.Lock()
+    l.out.Flush()
+    l.mu.Unlock()
+}
+
+// flushEvery flushes the log every interval until ctx is done.
+func (l *accessLogger) flushEvery(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-t.C:
+            l.flush()
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// metrics holds the counters exported in Prometheus text format at /metrics.
+type metrics struct {
+    requests      atomic.Uint64
+    inFlight      atomic.Int64
+    bytesReceived atomic.Uint64
+    bytesSent     atomic.Uint64
+}
+
+// countingReader adds the bytes read from a request body to a counter.
+type countingReader struct {
+    io.ReadCloser
+    n *atomic.Uint64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+    n, err := cr.ReadCloser.Read(p)
+    cr.n.Add(uint64(n))
+    return n, err
+}
+
+func (m *metrics) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        m.requests.Add(1)
+        m.inFlight.Add(1)
+        defer m.inFlight.Add(-1)
+        r.Body = countingReader{ReadCloser: r.Body, n: &m.bytesReceived}
+        rw := &responseRecorder{ResponseWriter: w}
+        defer func() { m.bytesSent.Add(uint64(rw.bytes)) }()
+        next.ServeHTTP(rw, r)
+    })
+}
+
+func (m *metrics) handle(w http.ResponseWriter, r *http.Request) {
+    var b []byte
+    metric := func(name, typ, help string, value any) {
+        b = fmt.Appendf(b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+    }
+    metric("benchserver_requests_total", "counter", "Total HTTP requests received.", m.requests.Load())
+    metric("benchserver_requests_in_flight", "gauge", "HTTP requests currently being served.", m.inFlight.Load())
+    metric("benchserver_request_bytes_total", "counter", "Request body bytes read.", m.bytesReceived.Load())
+    metric("benchserver_response_bytes_total", "counter", "Response body bytes written.", m.bytesSent.Load())
+
+    var ms runtime.MemStats
+    runtime.ReadMemStats(&ms)
+    metric("go_goroutines", "gauge", "Number of goroutines that currently exist.", runtime.NumGoroutine())
+    metric("go_threads", "gauge", "Number of OS threads created.", pprof.Lookup("threadcreate").Count())
+    metric("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", ms.Alloc)
+    metric("go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.", ms.TotalAlloc)
+    metric("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", ms.Sys)
+    metric("go_memstats_mallocs_total", "counter", "Total number of mallocs.", ms.Mallocs)
+    metric("go_memstats_frees_total", "counter", "Total number of frees.", ms.Frees)
+    metric("go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.", ms.HeapAlloc)
+    metric("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", ms.HeapInuse)
+    metric("go_memstats_heap_objects", "gauge", "Number of allocated objects.", ms.HeapObjects)
+    metric("go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.", ms.NextGC)
+    metric("go_memstats_gc_sys_bytes", "gauge", "Number of bytes used for garbage collection system metadata.", ms.GCSys)
+    metric("go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of last garbage collection.", float64(ms.LastGC)/1e9)
+
+    gc := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+    debug.ReadGCStats(&gc)
+    b = append(b, "# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.\n# TYPE go_gc_duration_seconds summary\n"...)
+    for i, q := range []string{"0", "0.25", "0.5", "0.75", "1"} {
+        b = fmt.Appendf(b, "go_gc_duration_seconds{quantile=%q} %v\n", q, gc.PauseQuantiles[i].Seconds())
+    }
+    b = fmt.Appendf(b, "go_gc_duration_seconds_sum %v\ngo_gc_duration_seconds_count %d\n", gc.PauseTotal.Seconds(), gc.NumGC)
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    w.Write(b)
+}
+
+// histSubBits sets the histogram precision: each power of two is split into
+// 1<<histSubBits linear buckets, bounding the relative error to about 6%.
+const histSubBits = 4
+
+// histogram is a lock-free HDR-style log-linear histogram of durations.
+type histogram struct {
+    counts [64 << histSubBits]atomic.Uint64
+    max    atomic.Int64
+
+    mu    sync.Mutex // guards since
+    since time.Time
+}
+
+type histogramSnapshot struct {
+    Since time.Time `json:"since"`
+    Count uint64    `json:"count"`
+    P50   float64   `json:"p50_us"`
+    P90   float64   `json:"p90_us"`
+    P99   float64   `json:"p99_us"`
+    Max   float64   `json:"max_us"`
+}
+
+func newHistogram() *histogram {
+    return &histogram{since: time.Now()}
+}
+
+func bucketIndex(v uint64) int {
+    if v < 1<<histSubBits {
+        return int(v)
+    }
+    exp := bits.Len64(v) - 1 - histSubBits
+    sub := int(v>>exp) & (1<<histSubBits - 1)
+    return (exp+1)<<histSubBits + sub
+}
+
+// bucketUpper returns the highest value that maps to bucket i.
+func bucketUpper(i int) uint64 {
+    if i < 1<<histSubBits {
+        return uint64(i)
+    }
+    exp := i>>histSubBits - 1
+    sub := uint64(i & (1<<histSubBits - 1))
+    return (1<<histSubBits+sub)<<exp + 1<<exp - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+    ns := max(int64(d), 0)
+    h.counts[bucketIndex(uint64(ns))].Add(1)
+    for {
+        cur := h.max.Load()
+        if ns <= cur || h.max.CompareAndSwap(cur, ns) {
+            return
+        }
+    }
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+    var counts [len(h.counts)]uint64
+    var total uint64
+    for i := range h.counts {
+        counts[i] = h.counts[i].Load()
+        total += counts[i]
+    }
+    maxNs := h.max.Load()
+    quantile := func(q float64) float64 {
+        if total == 0 {
+            return 0
+        }
+        rank := uint64(q * float64(total))
+        var seen uint64
+        for i, c := range counts {
+            seen += c
+            if seen > rank {
+                return micros(min(int64(bucketUpper(i)), maxNs))
+            }
+        }
+        return micros(maxNs)
+    }
+    h.mu.Lock()
+    since := h.since
+    h.mu.Unlock()
+    return histogramSnapshot{
+        Since: since,
+        Count: total,
+        P50:   quantile(0.50),
+        P90:   quantile(0.90),
+        P99:   quantile(0.99),
+        Max:   micros(maxNs),
+    }
+}
+
+func (h *histogram) reset() {
+    for i := range h.counts {
+        h.counts[i].Store(0)
+    }
+    h.max.Store(0)
+    h.mu.Lock()
+    h.since = time.Now()
+    h.mu.Unlock()
+}
+
+func micros(ns int64) float64 {
+    return float64(ns) / 1e3
+}
+
+// registerFlags defines the server's flags on fs, storing their values in
+// cfg.
+func registerFlags(fs *flag.FlagSet, cfg *config) {
+    fs.Func("addr", "TCP address to listen on; repeat to serve several ports from one process (default :8000)", func(v string) error {
+        cfg.addrs = append(cfg.addrs, v)
+        return nil
+    })
+    fs.StringVar(&cfg.unixSocket, "unix", "", "listen on this Unix domain socket path instead of -addr")
+    fs.BoolVar(&cfg.noDelay, "nodelay", true, "set TCP_NODELAY on accepted connections (false enables Nagle's algorithm)")
+    fs.BoolVar(&cfg.reusePort, "reuseport", false, "set SO_REUSEPORT so several servers can share a port (Linux, BSD, macOS)")
+    fs.IntVar(&cfg.backlog, "backlog", 0, "listen backlog (0 keeps the OS default; capped by somaxconn)")
+    fs.BoolVar(&cfg.proxyProtocol, "proxy-protocol", false, "require a PROXY protocol v1/v2 header on each connection and use its client address")
+    fs.StringVar(&cfg.proto, "proto", "h1", "protocol mode: h1 (HTTP/1.1 cleartext), h2c (HTTP/2 prior knowledge cleartext) or h2 (TLS with ALPN)")
+    fs.StringVar(&cfg.certFile, "cert", "", "TLS certificate file for -proto=h2")
+    fs.StringVar(&cfg.keyFile, "key", "", "TLS key file for -proto=h2")
+    fs.StringVar(&cfg.clientCAFile, "client-ca", "", "CA bundle used to require and verify client certificates (mTLS) with -proto=h2")
+    fs.StringVar(&cfg.tlsResumption, "tls-resumption", "tickets", "TLS session resumption with -proto=h2: tickets, cache (server-side session store) or off")
+    fs.BoolVar(&cfg.verbose, "v", false, "log the negotiated protocol of each connection")
+    fs.BoolVar(&cfg.connLog, "conn-log", false, "log each connection state transition (new, active, idle, closed)")
+    fs.BoolVar(&cfg.keepAlive, "keepalive", true, "allow persistent connections; false closes every connection after one response")
+    fs.BoolVar(&cfg.http10, "http10", false, "respond with HTTP/1.0 semantics: HTTP/1.0 status lines, no chunking, close unless an HTTP/1.0 client negotiates keep-alive")
+    fs.StringVar(&cfg.logFormat, "log", "off", "per-request access log format: off, text or json")
+    fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 5*time.Second, "how long to wait for in-flight requests to drain on SIGINT/SIGTERM")
+    fs.DurationVar(&cfg.drainDelay, "drain-delay", 0, "on SIGINT/SIGTERM, keep serving with /readyz failing for this long before shutting down")
+    fs.DurationVar(&cfg.warmup, "warmup", 0, "time after startup before /readyz reports ready")
+    fs.DurationVar(&cfg.readTimeout, "read-timeout", 0, "maximum time to read a whole request including the body (0 is none)")
+    fs.DurationVar(&cfg.readHeaderTimeout, "read-header-timeout", 0, "maximum time to read request headers (0 falls back to -read-timeout)")
+    fs.DurationVar(&cfg.writeTimeout, "write-timeout", 0, "maximum time from the end of the request headers to the end of the response; exceeding it resets the connection (0 is none)")
+    fs.IntVar(&cfg.maxHeaderBytes, "max-header-bytes", 0, "maximum request header size, plus 4 KiB of net/http slack; larger requests get 431 (0 uses the default of 1 MiB)")
+    fs.DurationVar(&cfg.idleTimeout, "idle-timeout", 0, "maximum time a keep-alive connection may sit idle (0 falls back to -read-timeout)")
+    fs.IntVar(&cfg.bodySize, "body-size", 0, "size in bytes of the generated response body (0 serves \"Hello, World!\")")
+    fs.BoolVar(&cfg.chunked, "chunked", false, "stream bodies with chunked transfer encoding instead of Content-Length")
+    fs.IntVar(&cfg.chunkSize, "chunk-size", 4096, "size in bytes of each write in chunked mode")
+    fs.Int64Var(&cfg.maxUpload, "max-upload", 0, "maximum request body size in bytes for /upload and /echo-body (0 is unlimited)")
+    fs.IntVar(&cfg.maxConcurrent, "max-concurrent", 0, "maximum requests handled at once; excess requests get 503 (0 is unlimited)")
+    fs.DurationVar(&cfg.queueTimeout, "queue-timeout", 0, "how long a request may wait for a -max-concurrent slot before being rejected")
+    fs.IntVar(&cfg.retryAfter, "retry-after", 1, "Retry-After seconds sent with -max-concurrent rejections")
+    fs.BoolVar(&cfg.compress, "compress", false, "compress responses with gzip or deflate according to Accept-Encoding")
+    fs.BoolVar(&cfg.metrics, "metrics", true, "serve Prometheus metrics at /metrics and count requests for them")
+    fs.StringVar(&cfg.sequence, "sequence", "503,503,200", "comma-separated status codes /sequence returns in order per client; the last repeats")
+    fs.StringVar(&cfg.staticDir, "static-dir", "", "serve files from this directory under /static/, with Range support")
+    fs.BoolVar(&cfg.genFiles, "gen-files", false, "at startup, populate an empty -static-dir with 1KiB, 1MiB and 100MiB files")
+    fs.StringVar(&cfg.extraHeaders, "extra-headers", "", "comma-separated Name:Value headers added to every response; repeat a name for multiple values")
+    fs.StringVar(&cfg.vhosts, "vhosts", "", "comma-separated host=body virtual hosts served at / by Host header; HTTP/2 requests for another vhost on a bound connection get 421")
+    fs.Uint64Var(&cfg.seed, "seed", 0, "seed for /random bodies so they are reproducible and carry an X-Body-Sha256 header (0 is a fresh random body per request, with the digest in a trailer)")
+    fs.Int64Var(&cfg.rate, "rate", 0, "limit response bodies to this many bytes per second per connection (0 is unlimited; ?rate= overrides per request)")
+    fs.Float64Var(&cfg.fuzzRate, "fuzz-responses", 0, "fraction of HTTP/1.1 responses (0-1) replaced with a malformed one; ?fuzz=<kind> forces one")
+    fs.StringVar(&cfg.fuzzKinds, "fuzz-kinds", "", "comma-separated malformations -fuzz-responses picks from (default all: "+malformationNames()+")")
+    fs.BoolVar(&cfg.serverTiming, "server-timing", false, "report queue, processing and body-write time in Server-Timing headers and trailers")
+    fs.DurationVar(&cfg.delay, "delay", 0, "fixed delay before each response is written (time-to-first-byte)")
+    fs.DurationVar(&cfg.jitter, "jitter", 0, "maximum uniform random delay added to -delay")
+    fs.DurationVar(&cfg.defaultWork, "default-work", 0, "CPU time burned by every request before responding, after -delay")
+    fs.IntVar(&cfg.defaultAlloc, "default-alloc", 0, fmt.Sprintf("MiB of memory allocated and held for the duration of every request (at most %d)", maxAllocMB))
 }
 
 func main() {
-    http.HandleFunc("/", handler)
-    fmt.Println("Go server listening on :8000")
-    if err := http.ListenAndServe(":8000", nil); err != nil {
-        panic(err)
+    var cfg config
+    registerFlags(flag.CommandLine, &cfg)
+    var configFile string
+    flag.StringVar(&configFile, "config", "", "JSON file of flag settings keyed by flag name; flags given on the command line take precedence")
+    flag.Parse()
+    if configFile != "" {
+        if err := loadConfig(flag.CommandLine, configFile, &cfg); err != nil {
+            log.Fatal(err)
+        }
+    } else if problems := validateConfig(cfg); len(problems) > 0 {
+        log.Fatalf("invalid settings:\n  %s", strings.Join(problems, "\n  "))
+    }
+    if len(cfg.addrs) == 0 {
+        cfg.addrs = []string{":8000"}
+    }
+
+    protos, err := protocols(cfg.proto)
+    if err != nil {
+        log.Fatal(err)
+    }
+    tlsMode := cfg.proto == "h2"
+    if cfg.genFiles {
+        if err := generateStaticFiles(cfg.staticDir); err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    s, err := newServer(cfg)
+    if err != nil {
+        log.Fatal(err)
+    }
+    var accessLog *accessLogger
+    if cfg.logFormat != "off" {
+        if accessLog, err = newAccessLogger(os.Stdout, cfg.logFormat); err != nil {
+            log.Fatal(err)
+        }
+    }
+    srv := &http.Server{
+        Handler:     s.stack(accessLog),
+        Protocols:   protos,
+        ConnContext: connContext,
+
+        ReadTimeout:       cfg.readTimeout,
+        ReadHeaderTimeout: cfg.readHeaderTimeout,
+        WriteTimeout:      cfg.writeTimeout,
+        IdleTimeout:       cfg.idleTimeout,
+        MaxHeaderBytes:    cfg.maxHeaderBytes,
+    }
+    srv.SetKeepAlivesEnabled(cfg.keepAlive)
+    if cfg.connLog {
+        srv.ConnState = connStateLogger()
+    }
+    if cfg.clientCAFile != "" {
+        if srv.TLSConfig, err = clientAuthConfig(cfg.clientCAFile); err != nil {
+            log.Fatal(err)
+        }
+    }
+    if tlsMode {
+        if srv.TLSConfig == nil {
+            srv.TLSConfig = &tls.Config{}
+        }
+        if err := setResumption(srv.TLSConfig, cfg.tlsResumption); err != nil {
+            log.Fatal(err)
+        }
+    }
+    lns, err := listen(cfg)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if cfg.proxyProtocol {
+        for i, ln := range lns {
+            lns[i] = proxyListener{ln}
+        }
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    if accessLog != nil {
+        go accessLog.flushEvery(ctx, time.Second)
+    }
+    errc := make(chan error, len(lns))
+    for _, ln := range lns {
+        go func() {
+            if tlsMode {
+                errc <- srv.ServeTLS(ln, cfg.certFile, cfg.keyFile)
+                return
+            }
+            errc <- srv.Serve(ln)
+        }()
+        fmt.Printf("Go server listening on %s (%s)\n", ln.Addr(), cfg.proto)
+    }
+
+    select {
+    case err := <-errc:
+        log.Fatal(err)
+    case <-ctx.Done():
+    }
+    stop()
+    s.draining.Store(true)
+    time.Sleep(cfg.drainDelay)
+    err = shutdown(srv, cfg.shutdownTimeout)
+    if accessLog != nil {
+        accessLog.flush()
+    }
+    if err != nil {
+        log.Printf("shutdown: %v", err)
+        os.Exit(1)
     }
 }
 
+// staticFileSizes are the files -gen-files creates, named by size.
+var staticFileSizes = []struct {
+    name string
+    size int64
+}{
+    {"1KiB.bin", 1 << 10},
+    {"1MiB.bin", 1 << 20},
+    {"100MiB.bin", 100 << 20},
+}
+
+// generateStaticFiles fills dir with files of the body pattern in the sizes
+// listed in staticFileSizes, unless dir already contains something.
+func generateStaticFiles(dir string) error {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return err
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    if len(entries) > 0 {
+        return nil
+    }
+    pattern := fillBody(len(bodyPattern) * 1024)
+    for _, f := range staticFileSizes {
+        if err := writePatternFile(filepath.Join(dir, f.name), f.size, pattern); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func writePatternFile(path string, size int64, pattern []byte) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    for rem := size; rem > 0; {
+        n := min(rem, int64(len(pattern)))
+        if _, err := f.Write(pattern[:n]); err != nil {
+            f.Close()
+            return err
+        }
+        rem -= n
+    }
+    return f.Close()
+}
+
+// listen opens a TCP listener for each -addr, or a Unix domain socket when
+// -unix is set. A stale socket left by a previous run is removed first; the
+// socket file is unlinked again when the listener is closed on shutdown.
+func listen(cfg config) ([]net.Listener, error) {
+    if cfg.unixSocket == "" {
+        lc := net.ListenConfig{}
+        if cfg.reusePort {
+            lc.Control = controlReusePort
+        }
+        var lns []net.Listener
+        for _, addr := range cfg.addrs {
+            ln, err := lc.Listen(context.Background(), "tcp", addr)
+            if err != nil {
+                for _, l := range lns {
+                    l.Close()
+                }
+                return nil, err
+            }
+            if cfg.backlog > 0 {
+                setBacklog(ln, cfg.backlog)
+            }
+            if !cfg.noDelay {
+                ln = noDelayListener{ln.(*net.TCPListener)}
+            }
+            lns = append(lns, ln)
+        }
+        return lns, nil
+    }
+    if fi, err := os.Lstat(cfg.unixSocket); err == nil {
+        if fi.Mode()&os.ModeSocket == 0 {
+            return nil, fmt.Errorf("%s exists and is not a socket", cfg.unixSocket)
+        }
+        if err := os.Remove(cfg.unixSocket); err != nil {
+            return nil, err
+        }
+    }
+    ln, err := net.Listen("unix", cfg.unixSocket)
+    if err != nil {
+        return nil, err
+    }
+    return []net.Listener{ln}, nil
+}
+
+// Socket options for -nodelay, -reuseport and -backlog. Only -nodelay is
+// portable. controlReusePort and setBacklog live in sockopt_unix.go for
+// Linux and the BSDs (including macOS), and in sockopt_other.go, which only
+// logs that the option is unsupported, for everything else.
+
+// noDelayListener turns TCP_NODELAY off on accepted connections, so small
+// writes are coalesced by Nagle's algorithm. Go enables TCP_NODELAY by
+// default.
+type noDelayListener struct {
+    *net.TCPListener
+}
+
+func (l noDelayListener) Accept() (net.Conn, error) {
+    c, err := l.AcceptTCP()
+    if err != nil {
+        return nil, err
+    }
+    c.SetNoDelay(false)
+    return c, nil
+}
+
+// proxyHeaderTimeout bounds how long a connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// proxyListener requires a PROXY protocol v1 or v2 header at the start of
+// every connection and reports the client address it carries as the
+// connection's RemoteAddr.
+type proxyListener struct {
+    net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+    c, err := l.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+    return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn parses the PROXY header on first use, from the connection's own
+// goroutine, so a slow client cannot stall Accept.
+type proxyConn struct {
+    net.Conn
+    r *bufio.Reader
+
+    once   sync.Once
+    parsed atomic.Bool
+    remote net.Addr
+    err    error
+}
+
+func (c *proxyConn) init() {
+    c.once.Do(func() {
+        c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+        c.remote, c.err = readProxyHeader(c.r)
+        c.Conn.SetReadDeadline(time.Time{})
+        c.parsed.Store(true)
+        if c.err != nil {
+            log.Printf("proxy protocol from %s: %v", c.Conn.RemoteAddr(), c.err)
+            c.Conn.Close()
+        }
+    })
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+    c.init()
+    if c.err != nil {
+        return 0, c.err
+    }
+    return c.r.Read(p)
+}
+
+// NetConn returns the underlying connection, like tls.Conn.NetConn.
+func (c *proxyConn) NetConn() net.Conn {
+    return c.Conn
+}
+
+// RemoteAddr waits for the PROXY header, since net/http records the address
+// once when it starts serving the connection. Code on the accept goroutine
+// must use peerAddr instead.
+func (c *proxyConn) RemoteAddr() net.Addr {
+    c.init()
+    if c.remote != nil {
+        return c.remote
+    }
+    return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a PROXY protocol header and returns the source
+// address it declares, or nil for UNKNOWN (v1) and LOCAL (v2) headers.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+    sig, err := r.Peek(len(proxyV2Signature))
+    if err == nil && string(sig) == proxyV2Signature {
+        return readProxyV2(r)
+    }
+    if p, err := r.Peek(6); err != nil || string(p) != "PROXY " {
+        return nil, errors.New("missing PROXY protocol header")
+    }
+    return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+    // A v1 header is at most 107 bytes including the CRLF.
+    var line []byte
+    for len(line) < 107 {
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        line = append(line, b)
+        if b == '\n' {
+            break
+        }
+    }
+    text, ok := strings.CutSuffix(string(line), "\r\n")
+    if !ok {
+        return nil, errors.New("malformed PROXY v1 header")
+    }
+    fields := strings.Fields(text)
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return nil, nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, fmt.Errorf("malformed PROXY v1 header %q", text)
+    }
+    ip, err := netip.ParseAddr(fields[2])
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.ParseUint(fields[4], 10, 16)
+    if err != nil {
+        return nil, err
+    }
+    return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+    var hdr [16]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return nil, err
+    }
+    if hdr[12]>>4 != 2 {
+        return nil, fmt.Errorf("unsupported PROXY v2 version %d", hdr[12]>>4)
+    }
+    body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    if hdr[12]&0x0f == 0 {
+        // LOCAL: a health check from the proxy itself.
+        return nil, nil
+    }
+    switch hdr[13] >> 4 {
+    case 1: // AF_INET
+        if len(body) < 12 {
+            return nil, errors.New("short PROXY v2 IPv4 address block")
+        }
+        ip := netip.AddrFrom4([4]byte(body[0:4]))
+        return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:]))), nil
+    case 2: // AF_INET6
+        if len(body) < 36 {
+            return nil, errors.New("short PROXY v2 IPv6 address block")
+        }
+        ip := netip.AddrFrom16([16]byte(body[0:16]))
+        return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:]))), nil
+    case 3: // AF_UNIX
+        if len(body) < 216 {
+            return nil, errors.New("short PROXY v2 unix address block")
+        }
+        name, _, _ := strings.Cut(string(body[:108]), "\x00")
+        return &net.UnixAddr{Name: name, Net: "unix"}, nil
+    }
+    return nil, nil
+}
+
+// shutdown stops accepting new connections and waits up to timeout for
+// in-flight requests to finish. HTTP/2 connections are sent a GOAWAY, so
+// clients stop opening streams on them while in-flight ones complete.
+func shutdown(srv *http.Server, timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if err := srv.Shutdown(ctx); err != nil {
+        if errors.Is(err, context.DeadlineExceeded) {
+            return fmt.Errorf("connections still open after %s", timeout)
+        }
+        return err
+    }
+    return nil
+}
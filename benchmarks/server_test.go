@@ -0,0 +1,357 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+    t.Helper()
+    s, err := newServer(config{sequence: "200", chunkSize: 4096})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts := httptest.NewServer(s.routes())
+    t.Cleanup(ts.Close)
+    return ts
+}
+
+// TestPipelinedResponsesInOrder sends a slow request and a fast one back to
+// back on one connection and checks the responses come back in request
+// order, with the fast one held behind the slow one.
+func TestPipelinedResponsesInOrder(t *testing.T) {
+    ts := newTestServer(t)
+    conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+    start := time.Now()
+    if _, err := io.WriteString(conn,
+        "GET /?delay=300ms HTTP/1.1\r\nHost: test\r\n\r\n"+
+            "GET /echo/3 HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+        t.Fatal(err)
+    }
+
+    br := bufio.NewReader(conn)
+    for i, want := range []string{"Hello, World!", "012"} {
+        resp, err := http.ReadResponse(br, nil)
+        if err != nil {
+            t.Fatalf("response %d: %v", i, err)
+        }
+        body, err := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil {
+            t.Fatalf("response %d body: %v", i, err)
+        }
+        if resp.StatusCode != http.StatusOK || string(body) != want {
+            t.Fatalf("response %d = %d %q, want 200 %q", i, resp.StatusCode, body, want)
+        }
+        if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+            t.Fatalf("response %d arrived after %s, before the delayed first response could finish", i, elapsed)
+        }
+    }
+}
+
+// TestHTTP10ResponsesWithCompress checks that -http10 still downgrades a
+// request that -compress clones to rewrite its If-None-Match, and that an
+// Expect: 100-continue request is refused rather than sent a 1xx.
+func TestHTTP10ResponsesWithCompress(t *testing.T) {
+    s, err := newServer(config{sequence: "200", chunkSize: 4096, keepAlive: true, http10: true, compress: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts := httptest.NewServer(s.stack(nil))
+    defer ts.Close()
+
+    for _, tc := range []struct {
+        request string
+        status  int
+    }{
+        {"GET /echo/100 HTTP/1.1\r\nHost: test\r\nAccept-Encoding: gzip\r\nIf-None-Match: \"other\"\r\n\r\n", http.StatusOK},
+        {"POST /expect HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\n", http.StatusExpectationFailed},
+    } {
+        conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(10 * time.Second))
+        // The second request must go unanswered: HTTP/1.0 closes after one.
+        if _, err := io.WriteString(conn, tc.request+"GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+            t.Fatal(err)
+        }
+        br := bufio.NewReader(conn)
+        resp, err := http.ReadResponse(br, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        if resp.Proto != "HTTP/1.0" || resp.StatusCode != tc.status {
+            t.Errorf("%q: got %s %d, want HTTP/1.0 %d", tc.request, resp.Proto, resp.StatusCode, tc.status)
+        }
+        if resp, err := http.ReadResponse(br, nil); err == nil {
+            t.Errorf("%q: connection stayed open and answered with %s %d", tc.request, resp.Proto, resp.StatusCode)
+        }
+    }
+}
+
+func TestResponseRecorderSkipsInformational(t *testing.T) {
+    rw := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+    rw.WriteHeader(http.StatusContinue)
+    rw.WriteHeader(http.StatusCreated)
+    if rw.status != http.StatusCreated {
+        t.Fatalf("status = %d, want %d", rw.status, http.StatusCreated)
+    }
+}
+
+// loadTestConfig parses args and then applies a config file holding data.
+func loadTestConfig(t *testing.T, data string, args ...string) (config, error) {
+    t.Helper()
+    var cfg config
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    registerFlags(fs, &cfg)
+    if err := fs.Parse(args); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return cfg, loadConfig(fs, path, &cfg)
+}
+
+func TestLoadConfig(t *testing.T) {
+    cfg, err := loadTestConfig(t, `{
+        "addr": ["127.0.0.1:1", "127.0.0.1:2"],
+        "body-size": 100,
+        "chunked": true,
+        "delay": "1s",
+        "sequence": "500,200"
+    }`, "-delay", "2s", "-sequence", "200")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !slices.Equal(cfg.addrs, []string{"127.0.0.1:1", "127.0.0.1:2"}) || cfg.bodySize != 100 || !cfg.chunked {
+        t.Errorf("file values not applied: addrs %q, body-size %d, chunked %v", cfg.addrs, cfg.bodySize, cfg.chunked)
+    }
+    if cfg.delay != 2*time.Second || cfg.sequence != "200" {
+        t.Errorf("command line overridden: delay %s, sequence %q", cfg.delay, cfg.sequence)
+    }
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+    _, err := loadTestConfig(t, `{
+        "addr": 5,
+        "bogus": 1,
+        "body-size": -10,
+        "chunk-size": -5,
+        "read-timeout": "-1s",
+        "retry-after": "soon",
+        "proto": "h3"
+    }`)
+    if err == nil {
+        t.Fatal("invalid config accepted")
+    }
+    for _, want := range []string{
+        "addr: want a string, got 5",
+        "bogus: unknown setting",
+        "retry-after: invalid value",
+        `unknown -proto "h3"`,
+        "-chunk-size must be positive",
+        "-body-size must not be negative",
+        "-read-timeout must not be negative",
+    } {
+        if !strings.Contains(err.Error(), want) {
+            t.Errorf("error does not mention %q:\n%v", want, err)
+        }
+    }
+}
+
+// clientFrame encodes a masked client frame. ext forces the 16-bit (126) or
+// 64-bit (127) length form; 0 picks the shortest.
+func clientFrame(b0 byte, payload []byte, ext byte) []byte {
+    mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+    var b bytes.Buffer
+    b.WriteByte(b0)
+    switch n := len(payload); {
+    case ext == 127 || n > 0xffff:
+        b.WriteByte(0x80 | 127)
+        binary.Write(&b, binary.BigEndian, uint64(n))
+    case ext == 126 || n > 125:
+        b.WriteByte(0x80 | 126)
+        binary.Write(&b, binary.BigEndian, uint16(n))
+    default:
+        b.WriteByte(0x80 | byte(n))
+    }
+    b.Write(mask[:])
+    for i, c := range payload {
+        b.WriteByte(c ^ mask[i%4])
+    }
+    return b.Bytes()
+}
+
+func TestReadWebSocketFrame(t *testing.T) {
+    long := bytes.Repeat([]byte("x"), 300)
+    oversize := []byte{0x80 | wsOpBinary, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+    binary.BigEndian.PutUint64(oversize[2:], maxWebSocketPayload+1)
+    for _, tc := range []struct {
+        name    string
+        frame   []byte
+        fin     bool
+        op      byte
+        payload []byte
+        err     error
+    }{
+        {"masked text", clientFrame(0x80|wsOpText, []byte("hello"), 0), true, wsOpText, []byte("hello"), nil},
+        {"fragment", clientFrame(wsOpText, []byte("he"), 0), false, wsOpText, []byte("he"), nil},
+        {"16-bit length", clientFrame(0x80|wsOpBinary, long, 0), true, wsOpBinary, long, nil},
+        {"64-bit length", clientFrame(0x80|wsOpBinary, long, 127), true, wsOpBinary, long, nil},
+        {"ping", clientFrame(0x80|wsOpPing, []byte("p"), 0), true, wsOpPing, []byte("p"), nil},
+        {"close", clientFrame(0x80|wsOpClose, []byte{0x03, 0xe8}, 0), true, wsOpClose, []byte{0x03, 0xe8}, nil},
+        {"unmasked", []byte{0x80 | wsOpText, 2, 'h', 'i'}, false, 0, nil, wsError{wsCloseProtocolError}},
+        {"reserved bit", clientFrame(0x80|0x40|wsOpText, []byte("hi"), 0), false, 0, nil, wsError{wsCloseProtocolError}},
+        {"fragmented control", clientFrame(wsOpPing, []byte("p"), 0), false, 0, nil, wsError{wsCloseProtocolError}},
+        {"long control", clientFrame(0x80|wsOpPing, long[:126], 0), false, 0, nil, wsError{wsCloseProtocolError}},
+        {"oversize", oversize, false, 0, nil, wsError{wsCloseTooBig}},
+        {"truncated", clientFrame(0x80|wsOpText, []byte("hello"), 0)[:8], false, 0, nil, io.ErrUnexpectedEOF},
+    } {
+        fin, op, payload, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(tc.frame)))
+        if tc.err != nil {
+            if !errors.Is(err, tc.err) {
+                t.Errorf("%s: err = %v, want %v", tc.name, err, tc.err)
+            }
+            continue
+        }
+        if err != nil || fin != tc.fin || op != tc.op || !bytes.Equal(payload, tc.payload) {
+            t.Errorf("%s: got fin %v op %#x payload %q err %v, want fin %v op %#x payload %q",
+                tc.name, fin, op, payload, err, tc.fin, tc.op, tc.payload)
+        }
+    }
+}
+
+// TestWebSocketOutlivesServerTimeouts checks that an echo session is not cut
+// off by the server's read and write deadlines.
+func TestWebSocketOutlivesServerTimeouts(t *testing.T) {
+    s, err := newServer(config{sequence: "200", chunkSize: 4096})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts := httptest.NewUnstartedServer(s.routes())
+    ts.Config.ReadTimeout = 200 * time.Millisecond
+    ts.Config.WriteTimeout = 200 * time.Millisecond
+    ts.Start()
+    defer ts.Close()
+
+    conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+        "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+    br := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(br, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.StatusCode != http.StatusSwitchingProtocols {
+        t.Fatalf("upgrade status = %d", resp.StatusCode)
+    }
+
+    time.Sleep(500 * time.Millisecond)
+    if _, err := conn.Write(clientFrame(0x80|wsOpText, []byte("still here"), 0)); err != nil {
+        t.Fatal(err)
+    }
+    hdr := make([]byte, 2)
+    if _, err := io.ReadFull(br, hdr); err != nil {
+        t.Fatalf("no echo after the server timeouts passed: %v", err)
+    }
+    payload := make([]byte, hdr[1]&0x7f)
+    if _, err := io.ReadFull(br, payload); err != nil || string(payload) != "still here" {
+        t.Fatalf("echo = %q, %v", payload, err)
+    }
+}
+
+// proxyV2 encodes a PROXY v2 header with the given version/command byte,
+// family/protocol byte and address block.
+func proxyV2(verCmd, fam byte, body []byte) string {
+    hdr := []byte(proxyV2Signature)
+    hdr = append(hdr, verCmd, fam)
+    hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+    return string(append(hdr, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+    inet := append([]byte{192, 0, 2, 1, 198, 51, 100, 1}, 0xdc, 0x04, 0x01, 0xbb)
+    inet6 := make([]byte, 36)
+    copy(inet6, net.ParseIP("2001:db8::1"))
+    copy(inet6[16:], net.ParseIP("2001:db8::2"))
+    binary.BigEndian.PutUint16(inet6[32:], 4000)
+    binary.BigEndian.PutUint16(inet6[34:], 443)
+    for _, tc := range []struct {
+        name, header string
+        addr         string // "" for no address
+        wantErr      bool
+    }{
+        {"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+        {"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n", "[2001:db8::1]:4000", false},
+        {"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+        {"v1 no crlf within 107 bytes", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+        {"v1 bare lf", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", true},
+        {"v1 missing fields", "PROXY TCP4 192.0.2.1\r\n", "", true},
+        {"v1 bad address", "PROXY TCP4 192.0.2.x 198.51.100.1 56324 443\r\n", "", true},
+        {"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", "", true},
+        {"v2 inet", proxyV2(0x21, 0x11, inet), "192.0.2.1:56324", false},
+        {"v2 inet6", proxyV2(0x21, 0x21, inet6), "[2001:db8::1]:4000", false},
+        {"v2 local", proxyV2(0x20, 0x00, nil), "", false},
+        {"v2 short inet", proxyV2(0x21, 0x11, inet[:8]), "", true},
+        {"v2 short inet6", proxyV2(0x21, 0x21, inet6[:20]), "", true},
+        {"v2 bad version", proxyV2(0x31, 0x11, inet), "", true},
+        {"v2 truncated", proxyV2(0x21, 0x11, inet)[:20], "", true},
+        {"missing header", "GET / HTTP/1.1\r\n", "", true},
+    } {
+        // A request follows a good header; a bad one ends the input, so a
+        // truncated header cannot borrow the request's bytes.
+        input := tc.header
+        if !tc.wantErr {
+            input += "GET / HTTP/1.1\r\n"
+        }
+        r := bufio.NewReader(strings.NewReader(input))
+        addr, err := readProxyHeader(r)
+        if tc.wantErr {
+            if err == nil {
+                t.Errorf("%s: got %v, want an error", tc.name, addr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", tc.name, err)
+            continue
+        }
+        if got := fmt.Sprint(addr); (tc.addr == "" && addr != nil) || (tc.addr != "" && got != tc.addr) {
+            t.Errorf("%s: addr = %v, want %q", tc.name, got, tc.addr)
+        }
+        if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+            t.Errorf("%s: header parsing consumed request bytes, left %q", tc.name, rest)
+        }
+    }
+}
@@ -0,0 +1,23 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+    "log"
+    "net"
+    "runtime"
+    "syscall"
+)
+
+// controlReusePort logs that SO_REUSEPORT is unavailable; the port is bound
+// exclusively.
+func controlReusePort(network, address string, c syscall.RawConn) error {
+    log.Printf("-reuseport is not supported on %s; binding %s exclusively", runtime.GOOS, address)
+    return nil
+}
+
+// setBacklog logs that the backlog cannot be changed; the OS default is
+// kept.
+func setBacklog(ln net.Listener, n int) {
+    log.Printf("-backlog is not supported on %s; keeping the default for %s", runtime.GOOS, ln.Addr())
+}
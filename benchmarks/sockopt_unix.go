@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+    "log"
+    "net"
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// controlReusePort sets SO_REUSEPORT on a listening socket before it is
+// bound. If the kernel refuses it, a warning is logged and the port is bound
+// exclusively.
+func controlReusePort(network, address string, c syscall.RawConn) error {
+    var serr error
+    if err := c.Control(func(fd uintptr) {
+        serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+    }); err != nil {
+        return err
+    }
+    if serr != nil {
+        log.Printf("-reuseport on %s: %v; binding exclusively", address, serr)
+    }
+    return nil
+}
+
+// setBacklog re-issues listen(2) on ln to change its accept queue length.
+// The kernel still caps it at its own limit (net.core.somaxconn on Linux,
+// kern.ipc.somaxconn on the BSDs).
+func setBacklog(ln net.Listener, n int) {
+    rc, err := ln.(*net.TCPListener).SyscallConn()
+    if err != nil {
+        log.Printf("-backlog on %s: %v", ln.Addr(), err)
+        return
+    }
+    var lerr error
+    rc.Control(func(fd uintptr) { lerr = unix.Listen(int(fd), n) })
+    if lerr != nil {
+        log.Printf("-backlog on %s: %v", ln.Addr(), lerr)
+    }
+}